@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache statuses recorded in the access log
+const (
+	cacheStatusHit    = "HIT"
+	cacheStatusMiss   = "MISS"
+	cacheStatusBypass = "BYPASS"
+	cacheStatusStale  = "STALE"
+)
+
+var accessLogFormats = []string{"json", "common", "combined", "logfmt"}
+
+func isAccessLogFormat(format string) bool {
+	for _, f := range accessLogFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLog is where access log lines go, nil when disabled
+var accessLog io.Writer
+
+// requestInfo collects what handlers learn about a request for its access
+// log line
+type requestInfo struct {
+	cacheStatus  string
+	upstreamTime time.Duration
+	cacheKey     string
+}
+
+type requestInfoContextKey struct{}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// setCacheStatus records how the cache handled a request
+func setCacheStatus(r *http.Request, key string, status string) {
+	traceCacheStatus(r, key, status)
+	if info := requestInfoFrom(r); info != nil {
+		info.cacheKey = key
+		info.cacheStatus = status
+	}
+}
+
+// addUpstreamTime records time spent waiting on an upstream
+func addUpstreamTime(r *http.Request, d time.Duration) {
+	if info := requestInfoFrom(r); info != nil {
+		info.upstreamTime += d
+	}
+}
+
+// statusRecorder remembers the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLogEntry is one access log line
+type accessLogEntry struct {
+	Time        time.Time `json:"time"`
+	ClientIP    string    `json:"client_ip"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	Proto       string    `json:"proto"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+	CacheKey    string    `json:"cache_key,omitempty"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	DurationMS  float64   `json:"duration_ms"`
+	UpstreamMS  float64   `json:"upstream_ms"`
+	Referer     string    `json:"referer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+}
+
+// withAccessLog records how every request went for the per-host and
+// duration metrics and writes an access log line. Server errors are always
+// logged; other requests are sampled at --access-log-sample.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, info)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		observeHostMetrics(r, info.cacheStatus, recorder.status, recorder.bytes)
+		observeRequestDuration(info.cacheStatus, time.Since(start))
+
+		if accessLog == nil {
+			return
+		}
+		if recorder.status < 500 && args.accessLogSample < 1 && rand.Float64() >= args.accessLogSample {
+			return
+		}
+
+		writeAccessLog(accessLog, args.accessLogFormat, accessLogEntry{
+			Time:        start,
+			ClientIP:    clientIP(r),
+			Method:      r.Method,
+			URL:         generateURL(r),
+			Proto:       r.Proto,
+			CacheStatus: info.cacheStatus,
+			CacheKey:    info.cacheKey,
+			Status:      recorder.status,
+			Bytes:       recorder.bytes,
+			DurationMS:  milliseconds(time.Since(start)),
+			UpstreamMS:  milliseconds(info.upstreamTime),
+			Referer:     r.Referer(),
+			UserAgent:   r.UserAgent(),
+		})
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+var accessLogLock sync.Mutex
+
+// writeAccessLog formats an entry and writes it as a single line
+func writeAccessLog(w io.Writer, format string, entry accessLogEntry) {
+	var line bytes.Buffer
+	switch format {
+	case "common", "combined":
+		// The standard Apache formats, so existing log tooling can read them
+		fmt.Fprintf(&line, "%s - - [%s] %q %d %s",
+			entry.ClientIP, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.URL+" "+entry.Proto, entry.Status, commonBytes(entry.Bytes))
+		if format == "combined" {
+			fmt.Fprintf(&line, " %q %q", entry.Referer, entry.UserAgent)
+		}
+		line.WriteByte('\n')
+	case "logfmt":
+		pairs := []struct {
+			key   string
+			value string
+		}{
+			{"time", entry.Time.UTC().Format(time.RFC3339Nano)},
+			{"client_ip", entry.ClientIP},
+			{"method", entry.Method},
+			{"url", entry.URL},
+			{"proto", entry.Proto},
+			{"cache_status", entry.CacheStatus},
+			{"cache_key", entry.CacheKey},
+			{"status", strconv.Itoa(entry.Status)},
+			{"bytes", strconv.FormatInt(entry.Bytes, 10)},
+			{"duration_ms", strconv.FormatFloat(entry.DurationMS, 'f', 3, 64)},
+			{"upstream_ms", strconv.FormatFloat(entry.UpstreamMS, 'f', 3, 64)},
+			{"referer", entry.Referer},
+			{"user_agent", entry.UserAgent},
+		}
+		for i, pair := range pairs {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(pair.key)
+			line.WriteByte('=')
+			line.WriteString(logfmtValue(pair.value))
+		}
+		line.WriteByte('\n')
+	default:
+		json.NewEncoder(&line).Encode(entry)
+	}
+
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	if _, err := w.Write(line.Bytes()); err != nil {
+		log.Printf("Error writing access log: %s", err)
+	}
+}
+
+func commonBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// logfmtValue quotes values that would otherwise be ambiguous
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// rotatingFile is an access log file that is rotated by size and/or age,
+// keeping a limited number of old files next to it
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// rotateFailed holds off rotating again for a while after it failed
+	rotateFailed time.Time
+}
+
+// rotateRetry is how long to keep writing to the current file after a
+// rotation failed before trying again
+const rotateRetry = time.Minute
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, size, err := openLogFile(r.path)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.size = size
+	r.opened = time.Now()
+	return nil
+}
+
+// openLogFile opens path for appending and returns its current size
+func openLogFile(path string) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	tooBig := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.maxAge > 0 && time.Since(r.opened) >= r.maxAge
+	if (tooBig || tooOld) && time.Since(r.rotateFailed) >= rotateRetry {
+		if err := r.rotate(); err != nil {
+			log.Printf("Error rotating access log %s, still writing to it: %s", r.path, err)
+			r.rotateFailed = time.Now()
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// backupTimeFormat is the suffix rotated logs get, sortable by age
+const backupTimeFormat = "20060102T150405.000000000"
+
+// logBackups lists the rotated copies of path, oldest first. Other files
+// that happen to share the prefix are left alone.
+func logBackups(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	backups := []string{}
+	for _, match := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(match, path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// rotate moves the current file aside with a timestamp and starts a new one.
+// The current file stays open until the new one is, so a failed rotation
+// leaves the log where it was. Callers hold the lock.
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	file, size, err := openLogFile(r.path)
+	if err != nil {
+		os.Rename(backup, r.path)
+		return err
+	}
+	r.file.Close()
+	r.file, r.size, r.opened = file, size, time.Now()
+
+	backups := logBackups(r.path)
+	for r.maxBackups > 0 && len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.file.Close()
+}
+
+// StartAccessLog opens the access log configured on the command line
+func StartAccessLog() error {
+	switch args.accessLog {
+	case "":
+		accessLog = nil
+		return nil
+	case "-", "stdout":
+		accessLog = os.Stdout
+		return nil
+	}
+
+	file, err := newRotatingFile(args.accessLog, args.accessLogMaxSize*1024*1024,
+		time.Duration(args.accessLogMaxAge)*time.Hour, args.accessLogMaxBackups)
+	if err != nil {
+		return err
+	}
+	accessLog = file
+	log.Printf("Writing %s access log to %s", args.accessLogFormat, args.accessLog)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAccessLog(t *testing.T) {
+	entry := accessLogEntry{
+		Time:        time.Date(2024, 2, 14, 22, 0, 0, 0, time.UTC),
+		ClientIP:    "192.168.1.42",
+		Method:      "GET",
+		URL:         "http://dl.example.com/game.pkg",
+		Proto:       "HTTP/1.1",
+		CacheStatus: cacheStatusHit,
+		Status:      200,
+		Bytes:       1024,
+		DurationMS:  12.5,
+		UserAgent:   "Valve/Steam HTTP Client 1.0",
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"common", `192.168.1.42 - - [14/Feb/2024:22:00:00 +0000] "GET http://dl.example.com/game.pkg HTTP/1.1" 200 1024` + "\n"},
+		{"combined", `192.168.1.42 - - [14/Feb/2024:22:00:00 +0000] "GET http://dl.example.com/game.pkg HTTP/1.1" 200 1024 "" "Valve/Steam HTTP Client 1.0"` + "\n"},
+		{"logfmt", `time=2024-02-14T22:00:00Z client_ip=192.168.1.42 method=GET url=http://dl.example.com/game.pkg proto=HTTP/1.1 cache_status=HIT cache_key="" status=200 bytes=1024 duration_ms=12.500 upstream_ms=0.000 referer="" user_agent="Valve/Steam HTTP Client 1.0"` + "\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeAccessLog(&buf, test.format, entry)
+		if buf.String() != test.expected {
+			t.Errorf("%s:\nexpected %q\n     got %q", test.format, test.expected, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	writeAccessLog(&buf, "json", entry)
+	decoded := accessLogEntry{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || decoded.CacheStatus != cacheStatusHit || decoded.Bytes != 1024 {
+		t.Errorf("json: unexpected line %q (%v)", buf.String(), err)
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	saveArgs(t)
+	var buf bytes.Buffer
+	accessLog = &buf
+	args.accessLogFormat = "json"
+	args.accessLogSample = 1
+	defer func() { accessLog = nil }()
+
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setCacheStatus(r, "12345", cacheStatusMiss)
+		addUpstreamTime(r, 5*time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not here"))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/missing.pkg", nil)
+	r.Host = "dl.example.com"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entry := accessLogEntry{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected line %q: %s", buf.String(), err)
+	}
+	if entry.Status != 404 || entry.Bytes != 8 || entry.CacheStatus != cacheStatusMiss || entry.CacheKey != "12345" || entry.UpstreamMS != 5 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.URL != "http://dl.example.com/missing.pkg" {
+		t.Errorf("unexpected url %s", entry.URL)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// Files that only share the prefix aren't backups
+	for _, other := range []string{".1", ".old"} {
+		if err := os.WriteFile(path+other, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := newRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := file.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every write but the first rotated, only two backups are kept
+	if backups := logBackups(path); len(backups) != 2 {
+		t.Errorf("expected 2 backups, got %v", backups)
+	}
+	for _, other := range []string{".1", ".old"} {
+		if _, err := os.Stat(path + other); err != nil {
+			t.Errorf("expected %s to be left alone: %s", path+other, err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if len(data) != len(line) {
+		t.Errorf("expected current file to hold one line, got %d bytes", len(data))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminRole is what a caller of the admin API may do
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleRead
+	roleAdmin
+)
+
+func (role adminRole) String() string {
+	switch role {
+	case roleRead:
+		return "read-only"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// adminIdentity is who made an admin API call
+type adminIdentity struct {
+	name string
+	via  string
+	role adminRole
+}
+
+// adminToken is a bearer token accepted by the admin API
+type adminToken struct {
+	name  string
+	token []byte
+	role  adminRole
+}
+
+// adminTokens are parsed from --admin-token and --admin-read-token
+var adminTokens []adminToken
+
+// parseAdminTokens parses "name:token" or bare "token" entries. Bare
+// tokens are named after their role and position for the logs.
+func parseAdminTokens(entries []string, role adminRole) ([]adminToken, error) {
+	tokens := []adminToken{}
+	for i, entry := range entries {
+		name := fmt.Sprintf("%s-token-%d", role, i+1)
+		token := entry
+		if parts := strings.SplitN(entry, ":", 2); len(parts) == 2 {
+			name, token = parts[0], parts[1]
+		}
+		if name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("admin tokens must be [name:]token with at least 16 characters")
+		}
+		tokens = append(tokens, adminToken{name: name, token: []byte(token), role: role})
+	}
+	return tokens, nil
+}
+
+// adminAuthEnabled reports whether the admin API asks callers who they are.
+// Without tokens or a client CA it stays open, as in earlier releases.
+func adminAuthEnabled() bool {
+	return len(adminTokens) > 0 || args.adminClientCA != ""
+}
+
+// authenticateAdmin works out who is calling from a bearer token or a
+// verified client certificate
+func authenticateAdmin(r *http.Request) adminIdentity {
+	if !adminAuthEnabled() {
+		return adminIdentity{name: "anonymous", via: "none", role: roleAdmin}
+	}
+
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		presented := []byte(strings.TrimSpace(auth[7:]))
+		for _, token := range adminTokens {
+			if subtle.ConstantTimeCompare(presented, token.token) == 1 {
+				return adminIdentity{name: token.name, via: "token", role: token.role}
+			}
+		}
+		return adminIdentity{via: "token", role: roleNone}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		role := roleRead
+		for _, admin := range args.adminClientAdmins {
+			if admin == name {
+				role = roleAdmin
+			}
+		}
+		return adminIdentity{name: name, via: "mtls", role: role}
+	}
+
+	return adminIdentity{role: roleNone}
+}
+
+// isPublicAPI lists endpoints that stay open: health for load balancer and
+// orchestrator probes, and the dashboard's static files
+func isPublicAPI(path string) bool {
+	switch path {
+	case "/api/health", "/api/livez", "/api/readyz":
+		return true
+	}
+	return strings.HasPrefix(path, dashboardPath)
+}
+
+// withAdminAuth lets read-only callers use safe methods and admins
+// everything else. Calls that change state are logged with the caller.
+func withAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicAPI(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity := authenticateAdmin(r)
+		if identity.role == roleNone {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tenta"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Authentication required",
+			})
+			return
+		}
+
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if !readOnly && identity.role < roleAdmin {
+			log.Printf("Admin %s %s denied for %s (%s, %s) from %s",
+				r.Method, r.URL.RequestURI(), identity.name, identity.via, identity.role, clientIP(r))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Admin role required",
+			})
+			return
+		}
+
+		if !readOnly {
+			log.Printf("Admin %s %s by %s (%s) from %s",
+				r.Method, r.URL.RequestURI(), identity.name, identity.via, clientIP(r))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminTLSConfig builds the admin listener's TLS settings. With a client
+// CA, certificates are verified when presented and map callers to roles;
+// callers without one can still use a bearer token.
+func adminTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if args.adminClientCA == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(args.adminClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", args.adminClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// validateAdmin checks the admin listener and authentication flags
+func validateAdmin() error {
+	adminTokens = nil
+	for role, entries := range map[adminRole][]string{roleAdmin: args.adminTokens, roleRead: args.adminReadTokens} {
+		tokens, err := parseAdminTokens(entries, role)
+		if err != nil {
+			return err
+		}
+		adminTokens = append(adminTokens, tokens...)
+	}
+
+	if (args.adminTLSCert == "") != (args.adminTLSKey == "") {
+		return fmt.Errorf("admin-tls-cert and admin-tls-key must be set together")
+	}
+	if args.adminTLSCert != "" && args.adminAddr == "" {
+		return fmt.Errorf("admin-tls-cert requires admin-addr")
+	}
+	if args.adminClientCA != "" && args.adminTLSCert == "" {
+		return fmt.Errorf("admin-client-ca requires admin-tls-cert and admin-tls-key")
+	}
+	if _, err := adminTLSConfig(); err != nil {
+		return fmt.Errorf("admin-client-ca: %w", err)
+	}
+	return nil
+}
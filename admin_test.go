@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	saveArgs(t)
+	args.adminTokens = []string{"ops:0123456789abcdef0123"}
+	args.adminReadTokens = []string{"fedcba9876543210fedc"}
+	args.adminClientCA = ""
+	args.adminClientAdmins = []string{"deploy-bot"}
+	if err := validateAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		args.adminTokens, args.adminReadTokens, adminTokens = nil, nil, nil
+	}()
+
+	handler := withAdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	certRequest := func(method string, cn string) *http.Request {
+		r := httptest.NewRequest(method, "/api/limits", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		request  *http.Request
+		expected int
+	}{
+		{"health is public", http.MethodGet, "/api/health", "", nil, http.StatusNoContent},
+		{"readyz is public", http.MethodGet, "/api/readyz", "", nil, http.StatusNoContent},
+		{"no credentials", http.MethodGet, "/api/limits", "", nil, http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/api/limits", "not-a-valid-token-at-all", nil, http.StatusUnauthorized},
+		{"read token reads", http.MethodGet, "/api/limits", "fedcba9876543210fedc", nil, http.StatusNoContent},
+		{"read token writes", http.MethodPut, "/api/limits", "fedcba9876543210fedc", nil, http.StatusForbidden},
+		{"admin token writes", http.MethodDelete, "/api/cache/delete", "0123456789abcdef0123", nil, http.StatusNoContent},
+		{"read certificate writes", "", "", "", certRequest(http.MethodPut, "dashboard"), http.StatusForbidden},
+		{"admin certificate writes", "", "", "", certRequest(http.MethodPut, "deploy-bot"), http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		r := test.request
+		if r == nil {
+			r = httptest.NewRequest(test.method, test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, w.Code)
+		}
+	}
+}
+
+func TestValidateAdmin(t *testing.T) {
+	saveArgs(t)
+	defer func() {
+		args.adminTokens, args.adminTLSCert, args.adminTLSKey, args.adminAddr, adminTokens = nil, "", "", "", nil
+	}()
+
+	args.adminTokens = []string{"short"}
+	if err := validateAdmin(); err == nil {
+		t.Error("expected short token to be rejected")
+	}
+
+	args.adminTokens = nil
+	args.adminTLSCert, args.adminTLSKey = "cert.pem", "key.pem"
+	if err := validateAdmin(); err == nil {
+		t.Error("expected TLS without admin-addr to be rejected")
+	}
+}
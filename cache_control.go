@@ -54,7 +54,7 @@ func shouldCacheResponse(resp *http.Response) bool {
 	// Don't cache if Cache-Control: no-store is present
 	cacheControl := ParseCacheControl(resp.Header.Get("Cache-Control"))
 	if cacheControl.NoStore {
-		if args.debug {
+		if debugEnabled() {
 			log.Printf("Skipping cache: no-store directive present")
 		}
 		return false
@@ -62,16 +62,16 @@ func shouldCacheResponse(resp *http.Response) bool {
 
 	// Don't cache non-200 responses
 	if resp.StatusCode != http.StatusOK {
-		if args.debug {
+		if debugEnabled() {
 			log.Printf("Skipping cache: status code %d", resp.StatusCode)
 		}
 		return false
 	}
 
-	// Don't cache if response has no content length
-	if resp.ContentLength <= 0 {
-		if args.debug {
-			log.Printf("Skipping cache: no content or invalid content-length")
+	// Don't cache empty responses. Unknown lengths (-1) are read to EOF.
+	if resp.ContentLength == 0 {
+		if debugEnabled() {
+			log.Printf("Skipping cache: no content")
 		}
 		return false
 	}
@@ -84,7 +84,7 @@ func canServeFromCache(cachedTime time.Time, cacheControl CacheControl) bool {
 	// If max-age is specified, check if still valid
 	if cacheControl.MaxAge >= 0 {
 		if time.Since(cachedTime) > time.Duration(cacheControl.MaxAge)*time.Second {
-			if args.debug {
+			if debugEnabled() {
 				log.Printf("Cached response expired (max-age=%d)", cacheControl.MaxAge)
 			}
 			return false
@@ -93,11 +93,3 @@ func canServeFromCache(cachedTime time.Time, cacheControl CacheControl) bool {
 
 	return true
 }
-
-// logRequest logs HTTP request/response with timing and size information
-func logRequest(method string, path string, statusCode int, duration time.Duration, size int64, source string) {
-	if args.debug {
-		log.Printf("[%s] %s %s %d - %dms - %d bytes", 
-			source, method, path, statusCode, duration.Milliseconds(), size)
-	}
-}
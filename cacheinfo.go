@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// unknownBreakdown groups entries cached without metadata, or without the
+// detail being broken down by
+const unknownBreakdown = "unknown"
+
+// otherBreakdown groups everything past the top entries of a breakdown
+const otherBreakdown = "other"
+
+// CacheBreakdown is the share of the cache taken by one host or content type
+type CacheBreakdown struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// CacheInfoResponse describes what the cache is made of
+type CacheInfoResponse struct {
+	TotalFiles       int              `json:"total_files"`
+	TotalSize        int64            `json:"total_size_bytes"`
+	SizeDistribution map[string]int   `json:"size_distribution"`
+	AgeDistribution  map[string]int   `json:"age_distribution"`
+	OldestAgeSeconds int64            `json:"oldest_age_seconds"`
+	NewestAgeSeconds int64            `json:"newest_age_seconds"`
+	Hosts            []CacheBreakdown `json:"hosts"`
+	ContentTypes     []CacheBreakdown `json:"content_types"`
+}
+
+func sizeBucket(size int64) string {
+	switch {
+	case size < 1<<20:
+		return "small_<1mb"
+	case size < 10<<20:
+		return "medium_1-10mb"
+	case size < 100<<20:
+		return "large_10-100mb"
+	default:
+		return "huge_>100mb"
+	}
+}
+
+func ageBucket(age time.Duration) string {
+	switch {
+	case age < time.Hour:
+		return "<1h"
+	case age < 24*time.Hour:
+		return "1h-1d"
+	case age < 7*24*time.Hour:
+		return "1d-7d"
+	case age < 30*24*time.Hour:
+		return "7d-30d"
+	default:
+		return ">30d"
+	}
+}
+
+// metaHost returns the origin host an entry was fetched from
+func metaHost(meta *CacheMeta) string {
+	if meta == nil {
+		return unknownBreakdown
+	}
+	u, err := neturl.Parse(meta.URL)
+	if err != nil || u.Host == "" {
+		return unknownBreakdown
+	}
+	return u.Host
+}
+
+// metaContentType returns an entry's media type without parameters
+func metaContentType(meta *CacheMeta) string {
+	if meta == nil {
+		return unknownBreakdown
+	}
+	mediaType, _, err := mime.ParseMediaType(meta.Header.Get("Content-Type"))
+	if err != nil {
+		return unknownBreakdown
+	}
+	return mediaType
+}
+
+// topBreakdown sorts a breakdown by bytes and folds everything past the
+// first limit entries into "other"
+func topBreakdown(counts map[string]*CacheBreakdown, limit int) []CacheBreakdown {
+	list := make([]CacheBreakdown, 0, len(counts))
+	for _, entry := range counts {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	if limit <= 0 || len(list) <= limit {
+		return list
+	}
+	other := CacheBreakdown{Name: otherBreakdown}
+	for _, entry := range list[limit:] {
+		other.Files += entry.Files
+		other.Bytes += entry.Bytes
+	}
+	return append(list[:limit], other)
+}
+
+func addBreakdown(counts map[string]*CacheBreakdown, name string, size int64) {
+	entry, ok := counts[name]
+	if !ok {
+		entry = &CacheBreakdown{Name: name}
+		counts[name] = entry
+	}
+	entry.Files++
+	entry.Bytes += size
+}
+
+// handleCacheInfo reports how the cache breaks down by size, age, origin
+// host and content type. ?top=N limits the host and content type lists.
+func handleCacheInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	top := 20
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "top must be a non-negative integer",
+			})
+			return
+		}
+		top = parsed
+	}
+
+	entries, err := indexEntries()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Error reading cache index: %s", err.Error()),
+		})
+		incErrors()
+		return
+	}
+
+	response := CacheInfoResponse{
+		SizeDistribution: map[string]int{
+			"small_<1mb":     0,
+			"medium_1-10mb":  0,
+			"large_10-100mb": 0,
+			"huge_>100mb":    0,
+		},
+		AgeDistribution: map[string]int{
+			"<1h":    0,
+			"1h-1d":  0,
+			"1d-7d":  0,
+			"7d-30d": 0,
+			">30d":   0,
+		},
+	}
+	hosts := map[string]*CacheBreakdown{}
+	contentTypes := map[string]*CacheBreakdown{}
+	now := time.Now()
+	var oldest, newest time.Time
+
+	for i := range entries {
+		entry := &entries[i]
+		response.TotalFiles++
+		response.TotalSize += entry.Size
+		response.SizeDistribution[sizeBucket(entry.Size)]++
+		response.AgeDistribution[ageBucket(now.Sub(entry.StoredAt))]++
+		if oldest.IsZero() || entry.StoredAt.Before(oldest) {
+			oldest = entry.StoredAt
+		}
+		if newest.IsZero() || entry.StoredAt.After(newest) {
+			newest = entry.StoredAt
+		}
+
+		var meta *CacheMeta
+		if !entry.NoMeta {
+			meta = &entry.CacheMeta
+		}
+		addBreakdown(hosts, metaHost(meta), entry.Size)
+		addBreakdown(contentTypes, metaContentType(meta), entry.Size)
+	}
+
+	if response.TotalFiles > 0 {
+		response.OldestAgeSeconds = int64(now.Sub(oldest).Seconds())
+		response.NewestAgeSeconds = int64(now.Sub(newest).Seconds())
+	}
+	response.Hosts = topBreakdown(hosts, top)
+	response.ContentTypes = topBreakdown(contentTypes, top)
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheInfo(t *testing.T) {
+	seedCache(t,
+		"http://dl.example.com/a.pkg",
+		"http://dl.example.com/b.pkg",
+		"http://cdn.example.org/c.pkg",
+	)
+
+	// Give one entry a content type and age it by two days
+	r, _ := newKeyRequest("http://cdn.example.org/c.pkg", "")
+	key := generateCacheFilename(generateURL(r), r)
+	header := http.Header{"Content-Type": []string{"application/octet-stream; charset=binary"}}
+	meta := newCacheMeta(key, "http://cdn.example.org/c.pkg", "", 10, header)
+	meta.StoredAt = time.Now().Add(-48 * time.Hour).UTC()
+	if err := writeMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleCacheInfo(w, httptest.NewRequest(http.MethodGet, "/api/cache/info?top=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	info := CacheInfoResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.TotalFiles != 4 || info.SizeDistribution["small_<1mb"] != 4 {
+		t.Errorf("expected 4 small files, got %+v", info)
+	}
+	if info.AgeDistribution["<1h"] != 3 || info.AgeDistribution["1d-7d"] != 1 {
+		t.Errorf("unexpected age distribution %v", info.AgeDistribution)
+	}
+	if info.OldestAgeSeconds < 47*3600 || info.NewestAgeSeconds > 60 {
+		t.Errorf("unexpected ages: oldest %d, newest %d", info.OldestAgeSeconds, info.NewestAgeSeconds)
+	}
+
+	expectedHosts := []CacheBreakdown{
+		{Name: "dl.example.com", Files: 2, Bytes: 20},
+		{Name: "other", Files: 2, Bytes: 16},
+	}
+	if len(info.Hosts) != len(expectedHosts) {
+		t.Fatalf("expected hosts %v, got %v", expectedHosts, info.Hosts)
+	}
+	for i, expected := range expectedHosts {
+		if info.Hosts[i] != expected {
+			t.Errorf("expected hosts %v, got %v", expectedHosts, info.Hosts)
+		}
+	}
+	if info.ContentTypes[0].Name != "unknown" || info.ContentTypes[1].Name != "other" {
+		t.Errorf("unexpected content types %v", info.ContentTypes)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// CacheEntry represents a single cached file
+type CacheEntry struct {
+	Filename   string `json:"filename"`
+	Size       int64  `json:"size"`
+	ModTime    string `json:"mod_time"`
+	URL        string `json:"url,omitempty"`
+	LastAccess string `json:"last_access,omitempty"`
+	Hits       int64  `json:"hits"`
+
+	modTime    time.Time
+	lastAccess time.Time
+}
+
+// CacheListResponse represents the response for listing cache entries
+type CacheListResponse struct {
+	Count      int          `json:"count"`
+	Total      *int         `json:"total,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Entries    []CacheEntry `json:"entries"`
+}
+
+// cacheListQuery is a parsed /api/cache/list request
+type cacheListQuery struct {
+	sort    string
+	desc    bool
+	limit   int
+	cursor  *indexPosition
+	host    purgeMatcher
+	minSize int64
+	maxSize int64
+	minAge  time.Duration
+	maxAge  time.Duration
+	ndjson  bool
+}
+
+// listSortOrders maps each sort order to the cache index order it reads,
+// nil being by key. Ties are broken by filename. Names, sizes and mtimes
+// don't change once cached, so paging by them is stable; hits and last
+// access move as entries are served, so an entry served while paging can
+// be skipped or listed twice.
+var listSortOrders = map[string][]byte{
+	"name":        nil,
+	"size":        bySizeBucket,
+	"mtime":       byStoredBucket,
+	"last_access": lruBucket,
+	"hits":        byHitsBucket,
+}
+
+func encodeListCursor(sortBy string, value int64, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%s", sortBy, value, key)))
+}
+
+func decodeListCursor(sortBy string, cursor string) (*indexPosition, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(data), ":", 3)
+	if len(parts) != 3 || parts[0] != sortBy {
+		return nil, fmt.Errorf("cursor does not match sort %q", sortBy)
+	}
+	value, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &indexPosition{Value: value, Key: parts[2]}, nil
+}
+
+// parseAge accepts Go durations plus a "d" suffix for days
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+func parseCacheListQuery(query neturl.Values) (*cacheListQuery, error) {
+	q := &cacheListQuery{
+		sort:   query.Get("sort"),
+		limit:  defaultListLimit,
+		ndjson: query.Get("format") == "ndjson",
+	}
+	if q.sort == "" {
+		q.sort = "name"
+	}
+	if _, ok := listSortOrders[q.sort]; !ok {
+		return nil, fmt.Errorf("sort must be one of name, size, mtime, last_access or hits")
+	}
+
+	// Names sort ascending, everything else largest or latest first
+	q.desc = q.sort != "name"
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+
+	if format := query.Get("format"); format != "" && format != "json" && format != "ndjson" {
+		return nil, fmt.Errorf("format must be json or ndjson")
+	}
+
+	// NDJSON streams everything unless asked for a page
+	if q.ndjson {
+		q.limit = 0
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.limit = limit
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeListCursor(q.sort, value)
+		if err != nil {
+			return nil, err
+		}
+		q.cursor = cursor
+	}
+
+	if host := query.Get("host"); host != "" {
+		q.host, _ = newPurgeMatcher(neturl.Values{"host": {host}})
+	}
+
+	for name, target := range map[string]*int64{"min_size": &q.minSize, "max_size": &q.maxSize} {
+		if value := query.Get(name); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative number of bytes", name)
+			}
+			*target = size
+		}
+	}
+	for name, target := range map[string]*time.Duration{"min_age": &q.minAge, "max_age": &q.maxAge} {
+		if value := query.Get(name); value != "" {
+			age, err := parseAge(value)
+			if err != nil {
+				return nil, err
+			}
+			*target = age
+		}
+	}
+
+	return q, nil
+}
+
+// matches applies the size, age and host filters
+func (q *cacheListQuery) matches(entry *CacheEntry, now time.Time) bool {
+	if entry.Size < q.minSize || (q.maxSize > 0 && entry.Size > q.maxSize) {
+		return false
+	}
+	age := now.Sub(entry.modTime)
+	if age < q.minAge || (q.maxAge > 0 && age > q.maxAge) {
+		return false
+	}
+	return q.host == nil || (entry.URL != "" && q.host(entry.URL))
+}
+
+// filtered reports whether any filter is set
+func (q *cacheListQuery) filtered() bool {
+	return q.host != nil || q.minSize > 0 || q.maxSize > 0 || q.minAge > 0 || q.maxAge > 0
+}
+
+func newCacheEntry(item *indexEntry) CacheEntry {
+	entry := CacheEntry{
+		Filename:   item.Key,
+		Size:       item.Size,
+		ModTime:    item.StoredAt.String(),
+		URL:        item.URL,
+		Hits:       item.Hits,
+		modTime:    item.StoredAt,
+		lastAccess: item.lastAccess(),
+	}
+	entry.LastAccess = entry.lastAccess.UTC().Format(time.RFC3339)
+	return entry
+}
+
+// scanCacheEntries walks the cache index in the requested order from the
+// cursor, calling fn with each entry that matches until it returns false
+func scanCacheEntries(q *cacheListQuery, fn func(entry *CacheEntry, pos indexPosition) bool) error {
+	now := time.Now()
+	return indexScan(listSortOrders[q.sort], q.desc, q.cursor, func(item *indexEntry, pos indexPosition) bool {
+		entry := newCacheEntry(item)
+		if !q.matches(&entry, now) {
+			return true
+		}
+		return fn(&entry, pos)
+	})
+}
+
+// countCacheEntries counts the entries matching the filters, wherever the
+// cursor is. With filters it takes a pass over the whole index.
+func countCacheEntries(q *cacheListQuery) (int, error) {
+	if !q.filtered() {
+		files, _, err := indexTotals()
+		return int(files), err
+	}
+
+	total := 0
+	now := time.Now()
+	err := indexScan(nil, false, nil, func(item *indexEntry, pos indexPosition) bool {
+		entry := newCacheEntry(item)
+		if q.matches(&entry, now) {
+			total++
+		}
+		return true
+	})
+	return total, err
+}
+
+// listCachePage reads up to limit entries from the cursor, and the cursor
+// of the next page if there are more
+func listCachePage(q *cacheListQuery) ([]CacheEntry, string, error) {
+	entries := []CacheEntry{}
+	nextCursor := ""
+	var last indexPosition
+	err := scanCacheEntries(q, func(entry *CacheEntry, pos indexPosition) bool {
+		if len(entries) == q.limit {
+			nextCursor = encodeListCursor(q.sort, last.Value, last.Key)
+			return false
+		}
+		entries = append(entries, *entry)
+		last = pos
+		return true
+	})
+	return entries, nextCursor, err
+}
+
+// handleCacheList lists cached items a page at a time, read in order from
+// the cache index.
+//
+// Query parameters: sort (name, size, mtime, last_access, hits), order (asc,
+// desc), limit, cursor (next_cursor of the previous page), host, min_size,
+// max_size, min_age, max_age and format (json, ndjson).
+func handleCacheList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q, err := parseCacheListQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	flushMetaHits()
+
+	// Without a limit NDJSON is streamed straight from the index
+	if q.ndjson && q.limit == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := writeNDJSON(w, q); err != nil {
+			log.Printf("Error listing cache index: %s", err)
+			incErrors()
+		}
+		return
+	}
+
+	// The total only comes with the first page, there's no point paying for
+	// it again on every page after that
+	entries, nextCursor, err := listCachePage(q)
+	var total *int
+	if err == nil && !q.ndjson && q.cursor == nil {
+		var count int
+		count, err = countCacheEntries(q)
+		total = &count
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Error reading cache index: %s", err.Error()),
+		})
+		incErrors()
+		return
+	}
+
+	if q.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if nextCursor != "" {
+			w.Header().Set("X-Next-Cursor", nextCursor)
+		}
+		encoder := json.NewEncoder(w)
+		for i := range entries {
+			if err := encoder.Encode(entries[i]); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	json.NewEncoder(w).Encode(CacheListResponse{
+		Count:      len(entries),
+		Total:      total,
+		NextCursor: nextCursor,
+		Entries:    entries,
+	})
+}
+
+// writeNDJSON writes every matching entry, one per line, as it is read
+// from the index. It flushes as it goes so scripts can start working
+// before the listing is complete.
+func writeNDJSON(w http.ResponseWriter, q *cacheListQuery) error {
+	flusher, _ := w.(http.Flusher)
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	written := 0
+	err := scanCacheEntries(q, func(entry *CacheEntry, pos indexPosition) bool {
+		// A client that went away ends the listing
+		if err := encoder.Encode(entry); err != nil {
+			return false
+		}
+		written++
+		if written%1000 == 0 && flusher != nil {
+			buffered.Flush()
+			flusher.Flush()
+		}
+		return true
+	})
+	buffered.Flush()
+	return err
+}
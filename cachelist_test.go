@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func listCache(t *testing.T, query string) CacheListResponse {
+	w := httptest.NewRecorder()
+	handleCacheList(w, httptest.NewRequest(http.MethodGet, "/api/cache/list?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+	}
+
+	response := CacheListResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestCacheListPagination(t *testing.T) {
+	seedCache(t,
+		"http://dl.example.com/a.pkg",
+		"http://dl.example.com/b.pkg",
+		"http://cdn.example.org/c.pkg",
+	)
+
+	// Give b.pkg three hits and c.pkg one
+	for url, hits := range map[string]int{"http://dl.example.com/b.pkg": 3, "http://cdn.example.org/c.pkg": 1} {
+		r, _ := newKeyRequest(url, "")
+		for i := 0; i < hits; i++ {
+			recordMetaHit(generateCacheFilename(generateURL(r), r))
+		}
+	}
+
+	seen := []int64{}
+	cursor := ""
+	for page := 0; page < 4; page++ {
+		response := listCache(t, "sort=hits&limit=2&cursor="+cursor)
+		if page == 0 && (response.Total == nil || *response.Total != 4) {
+			t.Errorf("expected total 4 on the first page, got %v", response.Total)
+		}
+		if page > 0 && response.Total != nil {
+			t.Errorf("page %d: expected no total after the first page, got %d", page, *response.Total)
+		}
+		for _, entry := range response.Entries {
+			seen = append(seen, entry.Hits)
+		}
+		cursor = response.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 4 || seen[0] != 3 || seen[1] != 1 || seen[2] != 0 || seen[3] != 0 {
+		t.Errorf("expected hits 3, 1, 0, 0 across pages, got %v", seen)
+	}
+
+	hosts := listCache(t, "host=dl.example.com")
+	if hosts.Count != 2 || hosts.Total == nil || *hosts.Total != 2 {
+		t.Errorf("expected 2 entries for dl.example.com, got %+v", hosts)
+	}
+
+	// The seeded legacy entry is 6 bytes, the rest 10
+	small := listCache(t, "max_size=8")
+	if small.Count != 1 || small.Entries[0].Filename != "12345" {
+		t.Errorf("expected only the legacy entry, got %+v", small)
+	}
+}
+
+func TestCacheListNDJSON(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg")
+
+	w := httptest.NewRecorder()
+	handleCacheList(w, httptest.NewRequest(http.MethodGet, "/api/cache/list?format=ndjson", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected application/x-ndjson, got %s", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %s", len(lines), w.Body.String())
+	}
+	entry := CacheEntry{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Errorf("line is not JSON: %s", err)
+	}
+}
+
+func TestCacheListBadRequest(t *testing.T) {
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	for _, query := range []string{"sort=color", "order=up", "limit=0", "cursor=!!", "min_age=soon", "sort=size&cursor=" + encodeListCursor("hits", 1, "x")} {
+		w := httptest.NewRecorder()
+		handleCacheList(w, httptest.NewRequest(http.MethodGet, "/api/cache/list?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
+
+// TestCacheListOrders pages through every sort order one entry at a time and
+// checks the pages add up to the full listing
+func TestCacheListOrders(t *testing.T) {
+	seedCache(t,
+		"http://dl.example.com/a.pkg",
+		"http://dl.example.com/b.pkg",
+		"http://cdn.example.org/c.pkg",
+	)
+	r, _ := newKeyRequest("http://dl.example.com/b.pkg", "")
+	recordMetaHit(generateCacheFilename(generateURL(r), r))
+
+	for sortBy := range listSortOrders {
+		for _, order := range []string{"asc", "desc"} {
+			query := "sort=" + sortBy + "&order=" + order
+			full := []string{}
+			for _, entry := range listCache(t, query).Entries {
+				full = append(full, entry.Filename)
+			}
+
+			paged := []string{}
+			cursor := ""
+			for page := 0; page < 10; page++ {
+				response := listCache(t, query+"&limit=1&cursor="+cursor)
+				for _, entry := range response.Entries {
+					paged = append(paged, entry.Filename)
+				}
+				if cursor = response.NextCursor; cursor == "" {
+					break
+				}
+			}
+
+			if len(full) != 4 || strings.Join(paged, ",") != strings.Join(full, ",") {
+				t.Errorf("%s: expected pages %v to match the full listing %v", query, paged, full)
+			}
+		}
+	}
+}
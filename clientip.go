@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxies are the networks allowed to tell us who the client is,
+// parsed from --trusted-proxies
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses CIDRs or bare IPs into networks
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy must be an IP or CIDR, got %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy must be an IP or CIDR, got %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolAllowed reports whether a peer may send a PROXY protocol
+// header. --proxy-protocol requires --trusted-proxies, so only they may.
+func proxyProtocolAllowed(ip net.IP) bool {
+	return isTrustedProxy(ip)
+}
+
+// addrIP returns the IP of a network address, or nil
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	return hostIP(addr.String())
+}
+
+// hostIP parses the IP out of "ip", "ip:port" or "[ipv6]:port"
+func hostIP(hostport string) net.IP {
+	host := strings.TrimSpace(hostport)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+// forwardedFor returns the client chain a proxy reported, oldest first.
+// The standard Forwarded header wins over X-Forwarded-For.
+func forwardedFor(r *http.Request) []string {
+	chain := []string{}
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					chain = append(chain, strings.Trim(pair[4:], `"`))
+				}
+			}
+		}
+		return chain
+	}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+// resolveClientIP works out the real client address. Forwarding headers
+// are only believed when they come from a trusted proxy, and are walked from
+// the nearest hop back until the first address we don't trust.
+func resolveClientIP(r *http.Request) string {
+	ip := hostIP(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+
+	if isTrustedProxy(ip) {
+		chain := forwardedFor(r)
+		for i := len(chain) - 1; i >= 0; i-- {
+			hop := hostIP(chain[i])
+			if hop == nil {
+				// "unknown" or an obfuscated identifier, we can't go further
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+
+	return ip.String()
+}
+
+type clientIPContextKey struct{}
+
+// withClientIP resolves the client IP once per request for everything
+// downstream to use
+func withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, resolveClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the resolved client IP for a request
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r)
+}
+
+// maxTrackedClients bounds the per-client statistics table
+const maxTrackedClients = 10000
+
+// ClientStats holds per-client proxy statistics
+type ClientStats struct {
+	IP          string `json:"ip"`
+	Requests    int64  `json:"requests"`
+	Hits        int64  `json:"hits"`
+	BytesServed int64  `json:"bytes_served"`
+	LastSeen    string `json:"last_seen"`
+	lastSeen    time.Time
+}
+
+var clients = struct {
+	sync.Mutex
+	stats map[string]*ClientStats
+}{stats: map[string]*ClientStats{}}
+
+// clientStatsFor returns the stats entry for ip. Callers hold clients.
+func clientStatsFor(ip string) *ClientStats {
+	stats, ok := clients.stats[ip]
+	if !ok {
+		if len(clients.stats) >= maxTrackedClients {
+			evictIdleClient()
+		}
+		stats = &ClientStats{IP: ip}
+		clients.stats[ip] = stats
+	}
+	stats.lastSeen = time.Now()
+	return stats
+}
+
+// evictIdleClient forgets the client we heard from longest ago. Callers
+// hold clients.
+func evictIdleClient() {
+	var oldest *ClientStats
+	for _, stats := range clients.stats {
+		if oldest == nil || stats.lastSeen.Before(oldest.lastSeen) {
+			oldest = stats
+		}
+	}
+	if oldest != nil {
+		delete(clients.stats, oldest.IP)
+	}
+}
+
+func recordClientRequest(ip string, hit bool) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	stats := clientStatsFor(ip)
+	stats.Requests++
+	if hit {
+		stats.Hits++
+	}
+}
+
+func recordClientBytes(ip string, size int64) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	clientStatsFor(ip).BytesServed += size
+}
+
+// topClients returns up to limit clients, most bytes served first
+func topClients(limit int) []ClientStats {
+	clients.Lock()
+	list := make([]ClientStats, 0, len(clients.stats))
+	for _, stats := range clients.stats {
+		entry := *stats
+		entry.LastSeen = stats.lastSeen.Format(time.RFC3339)
+		list = append(list, entry)
+	}
+	clients.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BytesServed > list[j].BytesServed
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
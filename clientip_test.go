@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = networks
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:51234",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer can't spoof",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "trusted load balancer",
+			remoteAddr: "10.1.2.3:40000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.20"},
+			expected:   "198.51.100.20",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.1.2.3:40000",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.20, 192.168.1.5"},
+			expected:   "198.51.100.20",
+		},
+		{
+			name:       "forwarded header wins",
+			remoteAddr: "192.168.1.5:40000",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711";proto=http`,
+				"X-Forwarded-For": "1.2.3.4",
+			},
+			expected: "2001:db8::1",
+		},
+		{
+			name:       "unknown hop stops the walk",
+			remoteAddr: "10.1.2.3:40000",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.20, for=unknown"},
+			expected:   "10.1.2.3",
+		},
+	}
+
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		if ip := resolveClientIP(r); ip != test.expected {
+			t.Errorf("%s: expected client IP `%s` doesn't match `%s`", test.name, test.expected, ip)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0x00, 0x0c)
+	v2 = append(v2, 198, 51, 100, 20, 10, 0, 0, 1)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], 4711)
+	binary.BigEndian.PutUint16(ports[2:4], 8080)
+	v2 = append(v2, ports...)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{
+			name:     "no header",
+			input:    []byte("GET / HTTP/1.1\r\n\r\n"),
+			expected: "",
+		},
+		{
+			name:     "v1 tcp4",
+			input:    []byte("PROXY TCP4 198.51.100.20 10.0.0.1 4711 8080\r\nGET / HTTP/1.1\r\n\r\n"),
+			expected: "198.51.100.20:4711",
+		},
+		{
+			name:     "v1 unknown",
+			input:    []byte("PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n\r\n"),
+			expected: "",
+		},
+		{
+			name:     "v2 tcp4",
+			input:    append(v2, []byte("GET / HTTP/1.1\r\n\r\n")...),
+			expected: "198.51.100.20:4711",
+		},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(test.input))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.(*net.TCPAddr).String()
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected address `%s` doesn't match `%s`", test.name, test.expected, got)
+		}
+
+		// Whatever follows the header must be left for the HTTP server
+		rest, _ := r.ReadString('\n')
+		if rest != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: expected request line after header, got %q", test.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocolAllowed(t *testing.T) {
+	trustedProxies = nil
+	if proxyProtocolAllowed(net.ParseIP("10.1.2.3")) {
+		t.Error("expected no peer to be allowed without trusted proxies")
+	}
+
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = networks
+	defer func() { trustedProxies = nil }()
+
+	if !proxyProtocolAllowed(net.ParseIP("10.1.2.3")) {
+		t.Error("expected a trusted proxy to be allowed")
+	}
+	if proxyProtocolAllowed(net.ParseIP("192.168.1.20")) {
+		t.Error("expected a LAN client not to be allowed")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to flag names to form environment variables, so
+// --data-dir can be set with TENTA_DATA_DIR
+const envPrefix = "TENTA_"
+
+// fileConfig holds the config file settings that have no flag
+type fileConfig struct {
+	KeyRules     []KeyRule    `yaml:"key-rules" toml:"key-rules"`
+	HostPolicies []HostPolicy `yaml:"host-policies" toml:"host-policies"`
+}
+
+// structuredSettings are config file keys decoded into fileConfig
+var structuredSettings = map[string]bool{"key-rules": true, "host-policies": true}
+
+// settingAliases are config file keys that set a flag with another name
+var settingAliases = map[string]string{"resolvers": "dns-resolver"}
+
+// reloadableFlags are applied again on SIGHUP. Everything else needs a
+// restart.
+var reloadableFlags = []string{
+	"debug",
+	"limit-origin",
+	"limit-origin-host",
+	"limit-origin-hosts",
+	"limit-client",
+	"limit-hit-priority",
+}
+
+// cliFlags are the flags given on the command line, which always win over
+// the config file and environment
+var cliFlags = map[string]bool{}
+
+// debugLogging mirrors --debug so it can change on reload while requests
+// are running
+var debugLogging int32
+
+func debugEnabled() bool {
+	return atomic.LoadInt32(&debugLogging) == 1
+}
+
+func setDebug(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&debugLogging, value)
+}
+
+// envName is the environment variable for a flag
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// configPath is the config file from --config or TENTA_CONFIG
+func configPath() string {
+	if args.configFile == "" && !cliFlags["config"] {
+		return os.Getenv(envName("config"))
+	}
+	return args.configFile
+}
+
+// readConfigFile parses a YAML or TOML file, picked by extension, into flag
+// values and the structured settings
+func readConfigFile(path string, flags *pflag.FlagSet) (map[string]string, fileConfig, error) {
+	values := map[string]string{}
+	config := fileConfig{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, config, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, config, err
+		}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, config, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return nil, config, err
+		}
+		if err := toml.Unmarshal(data, &config); err != nil {
+			return nil, config, err
+		}
+	default:
+		return nil, config, fmt.Errorf("unknown config format %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	for key, value := range raw {
+		if structuredSettings[key] {
+			continue
+		}
+		name := key
+		if alias, ok := settingAliases[key]; ok {
+			name = alias
+		}
+		if name == "config" || flags.Lookup(name) == nil {
+			return nil, config, fmt.Errorf("unknown setting %q", key)
+		}
+		values[name] = settingValue(value)
+	}
+
+	if err := validateCacheRules(config.KeyRules, config.HostPolicies); err != nil {
+		return nil, config, err
+	}
+	return values, config, nil
+}
+
+// settingValue formats a config file value the way the flag would be
+// written on the command line
+func settingValue(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			items = append(items, fmt.Sprintf("%s=%v", key, item))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// configValues merges the config file and environment into the values to
+// set on flags. The environment overrides the file.
+func configValues(flags *pflag.FlagSet) (map[string]string, fileConfig, error) {
+	values := map[string]string{}
+	config := fileConfig{KeyRules: defaultKeyRules}
+
+	if path := configPath(); path != "" {
+		fileValues, fileConfig, err := readConfigFile(path, flags)
+		if err != nil {
+			return nil, config, fmt.Errorf("config file %s: %w", path, err)
+		}
+		values = fileValues
+		if fileConfig.KeyRules != nil {
+			config.KeyRules = fileConfig.KeyRules
+		}
+		config.HostPolicies = fileConfig.HostPolicies
+	}
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && f.Name != "config" {
+			values[f.Name] = value
+		}
+	})
+	return values, config, nil
+}
+
+// setFlag sets a flag from the config file or environment, replacing
+// rather than adding to list and map values already set
+func setFlag(flags *pflag.FlagSet, name string, value string) error {
+	if name == "limit-origin-hosts" {
+		args.limitOriginHosts = map[string]int64{}
+		if value == "" {
+			return nil
+		}
+	}
+	if slice, ok := flags.Lookup(name).Value.(pflag.SliceValue); ok {
+		items := []string{}
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		if err := slice.Replace(items); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+	if err := flags.Set(name, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// loadConfig applies the config file and environment on top of the
+// defaults. Precedence is flags, then environment, then config file, then
+// defaults.
+func loadConfig(flags *pflag.FlagSet) error {
+	cliFlags = map[string]bool{}
+	flags.Visit(func(f *pflag.Flag) {
+		cliFlags[f.Name] = true
+	})
+
+	values, config, err := configValues(flags)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if cliFlags[name] {
+			continue
+		}
+		if err := setFlag(flags, name, value); err != nil {
+			return err
+		}
+	}
+
+	setCacheRules(config.KeyRules, config.HostPolicies)
+	setDebug(args.debug)
+	if path := configPath(); path != "" {
+		log.Printf("Loaded config file %s (%d key rules, %d host policies)",
+			path, len(config.KeyRules), len(config.HostPolicies))
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file and environment and applies the
+// settings that are safe to change while running. Flags given on the
+// command line keep their values. The new settings are parsed into a copy
+// and checked before any of them are applied.
+func reloadConfig(flags *pflag.FlagSet) error {
+	values, config, err := configValues(flags)
+	if err != nil {
+		return err
+	}
+
+	var debug bool
+	var limits BandwidthLimits
+	staged := reloadFlagSet(&debug, &limits)
+	debug = args.debug
+	limits = argsBandwidth()
+	limits.OriginHosts = map[string]int64{}
+	for host, rate := range args.limitOriginHosts {
+		limits.OriginHosts[host] = rate
+	}
+
+	for _, name := range reloadableFlags {
+		if cliFlags[name] {
+			continue
+		}
+		value, ok := values[name]
+		if !ok {
+			value = flags.Lookup(name).DefValue
+		}
+		if name == "limit-origin-hosts" {
+			limits.OriginHosts = map[string]int64{}
+			if !ok {
+				continue
+			}
+		}
+		if err := staged.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := validateBandwidth(limits); err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if cliFlags[name] || isReloadable(name) {
+			continue
+		}
+		// List and map flags print differently than they are written, so
+		// only simple values are compared
+		f := flags.Lookup(name)
+		switch f.Value.Type() {
+		case "string", "int", "int64", "bool":
+		default:
+			continue
+		}
+		if value != f.Value.String() {
+			log.Printf("Config setting %s changed, restart to apply it", name)
+		}
+	}
+
+	args.debug = debug
+	args.limitOrigin = limits.Origin
+	args.limitOriginHost = limits.OriginHost
+	args.limitOriginHosts = limits.OriginHosts
+	args.limitClient = limits.Client
+	args.limitHitPriority = limits.HitPriority
+	setDebug(args.debug)
+	configureBandwidth(limits)
+	setCacheRules(config.KeyRules, config.HostPolicies)
+	log.Printf("Reloaded config: debug=%t, %d key rules, %d host policies, bandwidth limits reapplied",
+		args.debug, len(config.KeyRules), len(config.HostPolicies))
+	return nil
+}
+
+// reloadFlagSet parses the reloadable flags into debug and limits rather
+// than args. Defining the flags resets both, so set them afterwards.
+func reloadFlagSet(debug *bool, limits *BandwidthLimits) *pflag.FlagSet {
+	staged := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+	staged.BoolVar(debug, "debug", false, "")
+	staged.Int64Var(&limits.Origin, "limit-origin", 0, "")
+	staged.Int64Var(&limits.OriginHost, "limit-origin-host", 0, "")
+	staged.StringToInt64Var(&limits.OriginHosts, "limit-origin-hosts", nil, "")
+	staged.Int64Var(&limits.Client, "limit-client", 0, "")
+	staged.BoolVar(&limits.HitPriority, "limit-hit-priority", false, "")
+	return staged
+}
+
+func isReloadable(name string) bool {
+	for _, reloadable := range reloadableFlags {
+		if reloadable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// StartReloader reloads the config on SIGHUP. Connections and downloads
+// in progress are not interrupted.
+func StartReloader(flags *pflag.FlagSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP received, reloading config")
+			if err := reloadConfig(flags); err != nil {
+				log.Printf("Error reloading config, keeping current settings: %s", err)
+			}
+		}
+	}()
+}
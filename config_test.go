@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// saveArgs puts args back once the test is done, so settings one test
+// changes don't leak into the next
+func saveArgs(t *testing.T) {
+	saved := args
+	t.Cleanup(func() {
+		args = saved
+	})
+}
+
+// testFlags copies tenta's flags into a fresh set, so flags changed by one
+// test don't look like command line flags to the next
+func testFlags(t *testing.T) *pflag.FlagSet {
+	saveArgs(t)
+	t.Cleanup(func() {
+		setCacheRules(defaultKeyRules, nil)
+		setDebug(false)
+	})
+
+	flags := pflag.NewFlagSet("tenta", pflag.ContinueOnError)
+	Cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		copy := *f
+		copy.Changed = false
+		flags.AddFlag(&copy)
+	})
+	return flags
+}
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	configs := map[string]string{
+		"tenta.yaml": `
+http-port: 9090
+max-body-size: 1024
+resolvers: [1.1.1.1:53, 9.9.9.9:53]
+limit-origin-hosts:
+  cdn.example.com: 500
+key-rules:
+  - name: mirrors
+    host: "*.mirror.example.com"
+    key: "mirror{path}"
+host-policies:
+  - host: private.example.com
+    bypass: true
+`,
+		"tenta.toml": `
+http-port = 9090
+max-body-size = 1024
+resolvers = ["1.1.1.1:53", "9.9.9.9:53"]
+
+[limit-origin-hosts]
+"cdn.example.com" = 500
+
+[[key-rules]]
+name = "mirrors"
+host = "*.mirror.example.com"
+key = "mirror{path}"
+
+[[host-policies]]
+host = "private.example.com"
+bypass = true
+`,
+	}
+
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			flags := testFlags(t)
+			args.configFile = writeConfig(t, name, content)
+
+			if err := loadConfig(flags); err != nil {
+				t.Fatal(err)
+			}
+			if args.httpPort != 9090 || args.maxBodySize != 1024 {
+				t.Errorf("http-port=%d max-body-size=%d, want 9090 and 1024", args.httpPort, args.maxBodySize)
+			}
+			if len(args.dnsResolvers) != 2 || args.dnsResolvers[1] != "9.9.9.9:53" {
+				t.Errorf("dns-resolver = %v", args.dnsResolvers)
+			}
+			if args.limitOriginHosts["cdn.example.com"] != 500 {
+				t.Errorf("limit-origin-hosts = %v", args.limitOriginHosts)
+			}
+
+			r, _ := newKeyRequest("http://a.mirror.example.com/pool/file.deb", "")
+			if key := generateCacheKey(generateURL(r), r); key != "mirror/pool/file.deb" {
+				t.Errorf("key = %q, want mirror/pool/file.deb", key)
+			}
+			if !hostPolicyFor("PRIVATE.example.com:80").Bypass {
+				t.Error("private.example.com is not bypassed")
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	flags := testFlags(t)
+	args.configFile = writeConfig(t, "tenta.yaml", "http-port: 9090\nmax-cache-age: 24\ndata-dir: /from/file\n")
+	os.Setenv("TENTA_MAX_CACHE_AGE", "48")
+	os.Setenv("TENTA_DATA_DIR", "/from/env")
+	defer os.Unsetenv("TENTA_MAX_CACHE_AGE")
+	defer os.Unsetenv("TENTA_DATA_DIR")
+
+	if err := flags.Parse([]string{"--data-dir", "/from/flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if args.httpPort != 9090 {
+		t.Errorf("http-port = %d, want 9090 from the config file", args.httpPort)
+	}
+	if args.maxCacheAge != 48 {
+		t.Errorf("max-cache-age = %d, want 48 from the environment", args.maxCacheAge)
+	}
+	if args.dataDir != "/from/flag" {
+		t.Errorf("data-dir = %s, want /from/flag from the command line", args.dataDir)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting":  "no-such-flag: 1\n",
+		"bad value":        "http-port: eighty\n",
+		"rule without key": "key-rules:\n  - name: broken\n    host: example.com\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			flags := testFlags(t)
+			args.configFile = writeConfig(t, "tenta.yaml", content)
+			if err := loadConfig(flags); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	flags := testFlags(t)
+	args.configFile = writeConfig(t, "tenta.ini", "http-port=1\n")
+	if err := loadConfig(flags); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	flags := testFlags(t)
+	path := writeConfig(t, "tenta.yaml", "limit-client: 1000\nlimit-origin-hosts: {a.example.com: 10}\n")
+	args.configFile = path
+	if err := flags.Parse([]string{"--limit-origin", "5000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+	defer configureBandwidth(BandwidthLimits{})
+
+	if err := os.WriteFile(path, []byte(`
+debug: true
+limit-origin: 1
+http-port: 9999
+limit-origin-hosts: {b.example.com: 20}
+key-rules:
+  - name: everything
+    user-agent: test
+    key: "fixed"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if !debugEnabled() {
+		t.Error("debug was not reloaded")
+	}
+	limits := currentBandwidth()
+	if limits.Client != 0 {
+		t.Errorf("limit-client = %d, want it back at its default", limits.Client)
+	}
+	if limits.Origin != 5000 {
+		t.Errorf("limit-origin = %d, want the command line value kept", limits.Origin)
+	}
+	if len(limits.OriginHosts) != 1 || limits.OriginHosts["b.example.com"] != 20 {
+		t.Errorf("limit-origin-hosts = %v, want only b.example.com", limits.OriginHosts)
+	}
+	if args.httpPort != 8080 {
+		t.Errorf("http-port = %d, should need a restart", args.httpPort)
+	}
+
+	r, _ := newKeyRequest("http://example.com/file", "test")
+	if key := generateCacheKey(generateURL(r), r); key != "fixed" {
+		t.Errorf("key = %q, want fixed", key)
+	}
+	r.Header = http.Header{}
+	if key := generateCacheKey(generateURL(r), r); key != "http://example.com/file" {
+		t.Errorf("key = %q, want the URL", key)
+	}
+
+	// A bad setting leaves everything as it was
+	if err := os.WriteFile(path, []byte("debug: false\nlimit-client: -1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(flags); err == nil {
+		t.Fatal("expected a negative limit to be rejected")
+	}
+	if !args.debug || args.limitClient != 0 || args.limitOriginHosts["b.example.com"] != 20 {
+		t.Errorf("expected a rejected reload not to change args, got debug=%t limit-client=%d limit-origin-hosts=%v",
+			args.debug, args.limitClient, args.limitOriginHosts)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countersInterval is how often lifetime request counters are written to
+// disk
+const countersInterval = time.Minute
+
+// RequestCounters are request totals as shown by /api/cache/stats
+type RequestCounters struct {
+	TotalRequests int64   `json:"total_requests"`
+	CacheHits     int64   `json:"cache_hits"`
+	CacheMisses   int64   `json:"cache_misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	NotFound      int64   `json:"not_found_404"`
+	ServerErrors  int64   `json:"server_errors_5xx"`
+	OtherErrors   int64   `json:"other_errors"`
+	BytesServed   int64   `json:"bytes_served"`
+}
+
+func (c RequestCounters) plus(other RequestCounters) RequestCounters {
+	c.TotalRequests += other.TotalRequests
+	c.CacheHits += other.CacheHits
+	c.CacheMisses += other.CacheMisses
+	c.NotFound += other.NotFound
+	c.ServerErrors += other.ServerErrors
+	c.OtherErrors += other.OtherErrors
+	c.BytesServed += other.BytesServed
+	return c.derive()
+}
+
+// derive fills in the hit ratio
+func (c RequestCounters) derive() RequestCounters {
+	c.HitRatio = 0
+	if c.TotalRequests > 0 {
+		c.HitRatio = float64(c.CacheHits) / float64(c.TotalRequests)
+	}
+	return c
+}
+
+// CounterTotals is the counters section of /api/cache/stats
+type CounterTotals struct {
+	TrackingSince time.Time       `json:"tracking_since"`
+	Lifetime      RequestCounters `json:"lifetime"`
+	SinceStart    RequestCounters `json:"since_start"`
+}
+
+// countersState is what's kept in the counters file
+type countersState struct {
+	TrackingSince time.Time       `json:"tracking_since"`
+	Lifetime      RequestCounters `json:"lifetime"`
+}
+
+// counters holds the lifetime totals of earlier runs. The current run's
+// counts stay in the atomic counters in prometheus.go.
+var counters = struct {
+	sync.Mutex
+	previous countersState
+	saved    countersState
+}{previous: countersState{TrackingSince: time.Now().UTC()}}
+
+func countersPath() string {
+	return filepath.Join(args.dataDir, internalDir, "counters.json")
+}
+
+// sinceStartCounters returns the counts of this run
+func sinceStartCounters() RequestCounters {
+	return RequestCounters{
+		TotalRequests: getRequestsCount(),
+		CacheHits:     getHitsCount(),
+		CacheMisses:   getMissesCount(),
+		NotFound:      getNotFoundCount(),
+		ServerErrors:  getServerErrCount(),
+		OtherErrors:   getErrorsCount(),
+		BytesServed:   getBytesServed(),
+	}.derive()
+}
+
+// getCounters returns lifetime and since-start counts for the stats API
+func getCounters() CounterTotals {
+	counters.Lock()
+	defer counters.Unlock()
+
+	sinceStart := sinceStartCounters()
+	return CounterTotals{
+		TrackingSince: counters.previous.TrackingSince,
+		Lifetime:      counters.previous.Lifetime.plus(sinceStart),
+		SinceStart:    sinceStart,
+	}
+}
+
+// loadCounters restores lifetime counts saved by a previous run
+func loadCounters() error {
+	data, err := os.ReadFile(countersPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state := countersState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	counters.Lock()
+	defer counters.Unlock()
+	counters.previous = state
+	counters.saved = state
+	return nil
+}
+
+// saveCounters writes the lifetime counts if anything changed. The lock is
+// held while writing so a reset can't be overwritten by an older save.
+func saveCounters() error {
+	counters.Lock()
+	defer counters.Unlock()
+
+	state := countersState{
+		TrackingSince: counters.previous.TrackingSince,
+		Lifetime:      counters.previous.Lifetime.plus(sinceStartCounters()),
+	}
+	if state == counters.saved {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeStateFile(countersPath(), data); err != nil {
+		return err
+	}
+	counters.saved = state
+	return nil
+}
+
+// resetCounters starts the lifetime and since-start counts over. The
+// Prometheus counters keep counting, rate() copes with them either way.
+func resetCounters() error {
+	counters.Lock()
+	counters.previous = countersState{TrackingSince: time.Now().UTC()}
+	for _, count := range []*int64{&requestsCount, &hitsCount, &missesCount, &errorsCount, &notFoundCount, &serverErrCount, &servedCount} {
+		atomic.StoreInt64(count, 0)
+	}
+	counters.Unlock()
+	return saveCounters()
+}
+
+// handleCountersReset resets the request counters of /api/cache/stats
+func handleCountersReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only POST method allowed",
+		})
+		return
+	}
+
+	if err := resetCounters(); err != nil {
+		// The counters are reset in memory, only saving them failed
+		log.Printf("Error saving reset counters: %s", err)
+		incErrors()
+	}
+	log.Printf("Request counters reset")
+	json.NewEncoder(w).Encode(getCounters())
+}
+
+// StartCounters loads lifetime counts and saves them periodically
+func StartCounters() {
+	if err := loadCounters(); err != nil {
+		log.Printf("Error loading request counters from %s, starting over: %s", countersPath(), err)
+	}
+
+	go func() {
+		for range time.Tick(countersInterval) {
+			if err := saveCounters(); err != nil {
+				log.Printf("Error saving request counters: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// restartStats forgets the request counters and bandwidth savings held in
+// memory and loads whatever was saved in the data dir, like a restart
+func restartStats(t *testing.T) {
+	for _, count := range []*int64{&requestsCount, &hitsCount, &missesCount, &errorsCount, &notFoundCount, &serverErrCount, &servedCount} {
+		atomic.StoreInt64(count, 0)
+	}
+	counters.Lock()
+	counters.previous = countersState{TrackingSince: time.Now().UTC()}
+	counters.saved = countersState{}
+	counters.Unlock()
+
+	savings.Lock()
+	savings.state = savingsState{TrackingSince: time.Now().UTC(), Hosts: map[string]*SavingsTotals{}}
+	savings.sinceStart = SavingsTotals{}
+	savings.dirty = false
+	savings.Unlock()
+
+	if err := loadCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSavings(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freshStats starts a test with no stats in a new data dir, and leaves none
+// behind for the next one
+func freshStats(t *testing.T) {
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	restartStats(t)
+
+	empty := t.TempDir()
+	t.Cleanup(func() {
+		args.dataDir = empty
+		restartStats(t)
+	})
+}
+
+func TestCountersPersist(t *testing.T) {
+	freshStats(t)
+
+	for i := 0; i < 4; i++ {
+		incRequests()
+	}
+	incHits()
+	incMisses()
+	addBytesServed(100)
+	if err := saveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	first := getCounters()
+
+	restartStats(t)
+	incRequests()
+	incHits()
+
+	expected := RequestCounters{TotalRequests: 5, CacheHits: 2, CacheMisses: 1, HitRatio: 0.4, BytesServed: 100}
+	current := getCounters()
+	if current.Lifetime != expected {
+		t.Errorf("expected lifetime %+v, got %+v", expected, current.Lifetime)
+	}
+	if sinceStart := (RequestCounters{TotalRequests: 1, CacheHits: 1, HitRatio: 1}); current.SinceStart != sinceStart {
+		t.Errorf("expected since start %+v, got %+v", sinceStart, current.SinceStart)
+	}
+	if !current.TrackingSince.Equal(first.TrackingSince) {
+		t.Errorf("expected tracking since %s, got %s", first.TrackingSince, current.TrackingSince)
+	}
+}
+
+func TestCountersReset(t *testing.T) {
+	freshStats(t)
+
+	incRequests()
+	w := httptest.NewRecorder()
+	handleCountersReset(w, httptest.NewRequest(http.MethodGet, "/api/cache/stats/reset", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleCountersReset(w, httptest.NewRequest(http.MethodPost, "/api/cache/stats/reset", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var reset CounterTotals
+	if err := json.NewDecoder(w.Body).Decode(&reset); err != nil {
+		t.Fatal(err)
+	}
+	if reset.Lifetime != (RequestCounters{}) || reset.SinceStart != (RequestCounters{}) {
+		t.Errorf("expected zero counters after a reset, got %+v", reset)
+	}
+
+	// The reset survives a restart
+	restartStats(t)
+	if lifetime := getCounters().Lifetime; lifetime != (RequestCounters{}) {
+		t.Errorf("expected zero lifetime counters after a restart, got %+v", lifetime)
+	}
+}
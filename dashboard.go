@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles is the web dashboard. It only talks to the JSON API and
+// loads nothing from the internet.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const dashboardPath = "/api/dashboard/"
+
+// dashboardHandler serves the dashboard's static files. They are public;
+// the page asks for a token when the API wants one.
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.StripPrefix(dashboardPath, http.FileServer(http.FS(files)))
+}
+
+// redirectToDashboard sends browsers opening the admin listener's root to
+// the dashboard
+func redirectToDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, dashboardPath, http.StatusFound)
+}
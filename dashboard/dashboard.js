@@ -0,0 +1,230 @@
+// tenta dashboard. Everything here comes from the JSON admin API, so the
+// page works on networks without internet access.
+(function () {
+  "use strict";
+
+  var POLL_MS = 2000;
+  var SLOW_POLL_MS = 30000;
+  var previous = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function api(path, options) {
+    options = options || {};
+    options.headers = options.headers || {};
+    var token = localStorage.getItem("tenta-token");
+    if (token) {
+      options.headers["Authorization"] = "Bearer " + token;
+    }
+    return fetch(path, options).then(function (resp) {
+      if (resp.status === 401) {
+        $("login").classList.remove("hidden");
+        throw new Error("authentication required");
+      }
+      return resp.json().then(function (body) {
+        if (!resp.ok) {
+          throw new Error(body.error || resp.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  function bytes(n) {
+    var units = ["B", "KB", "MB", "GB", "TB", "PB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+      n /= 1024;
+      i++;
+    }
+    return n.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+  }
+
+  function percent(n) {
+    return (n * 100).toFixed(1) + "%";
+  }
+
+  function cell(text, className) {
+    var td = document.createElement("td");
+    td.textContent = text;
+    if (className) {
+      td.className = className;
+      td.title = text;
+    }
+    return td;
+  }
+
+  function fillTable(id, rows, render) {
+    var body = $(id).querySelector("tbody");
+    body.textContent = "";
+    rows.forEach(function (row) {
+      var tr = document.createElement("tr");
+      render(row).forEach(function (td) {
+        tr.appendChild(td);
+      });
+      body.appendChild(tr);
+    });
+  }
+
+  function setStatus(ok, text) {
+    var status = $("status");
+    status.textContent = text;
+    status.className = "status " + (ok ? "ok" : "error");
+  }
+
+  function refreshStats() {
+    Promise.all([api("/api/cache/stats"), api("/api/health")]).then(function (results) {
+      var stats = results[0];
+      var health = results[1];
+      var now = Date.now();
+
+      setStatus(health.status === "healthy", health.status);
+      $("uptime").textContent = "up " + health.uptime;
+      $("disk-usage").textContent = bytes(stats.cache_size_bytes);
+      $("file-count").textContent = stats.file_count + " files";
+      $("hit-ratio-total").textContent = percent(stats.hit_ratio) + " since start";
+      $("bytes-saved").textContent = bytes(stats.bandwidth.lifetime.bytes_saved);
+      $("saved-ratio").textContent = percent(stats.bandwidth.lifetime.saved_ratio) + " of traffic from cache";
+
+      if (previous) {
+        var seconds = (now - previous.time) / 1000;
+        var hits = stats.cache_hits - previous.stats.cache_hits;
+        var misses = stats.cache_misses - previous.stats.cache_misses;
+        var requests = stats.total_requests - previous.stats.total_requests;
+        var served = stats.bytes_served - previous.stats.bytes_served;
+        $("hit-ratio").textContent = hits + misses > 0 ? percent(hits / (hits + misses)) : "–";
+        $("throughput").textContent = bytes(Math.max(served, 0) / seconds) + "/s";
+        $("requests-rate").textContent = (Math.max(requests, 0) / seconds).toFixed(1) + " requests/s";
+      }
+      previous = { time: now, stats: stats };
+    }).catch(function (err) {
+      setStatus(false, err.message);
+    });
+  }
+
+  function refreshDownloads() {
+    api("/api/downloads").then(function (body) {
+      var rate = 0;
+      body.downloads.forEach(function (d) {
+        rate += d.bytes_per_second;
+      });
+      $("download-count").textContent = body.count;
+      $("download-rate").textContent = bytes(rate) + "/s from upstream";
+      fillTable("downloads", body.downloads, function (d) {
+        var progress = document.createElement("progress");
+        progress.max = d.size > 0 ? d.size : 1;
+        progress.value = d.size > 0 ? d.bytes : 0;
+        var td = document.createElement("td");
+        td.appendChild(progress);
+        td.title = d.size > 0 ? bytes(d.bytes) + " of " + bytes(d.size) : bytes(d.bytes);
+        return [cell(d.url, "url"), cell(d.client), td, cell(bytes(d.bytes_per_second) + "/s")];
+      });
+    }).catch(function () {});
+  }
+
+  function refreshJobs() {
+    api("/api/prefetch").then(function (body) {
+      fillTable("jobs", body.jobs.slice(0, 10), function (job) {
+        var actions = document.createElement("td");
+        if (job.state === "running") {
+          var cancel = document.createElement("button");
+          cancel.className = "small";
+          cancel.textContent = "Cancel";
+          cancel.onclick = function () {
+            api("/api/prefetch/" + job.id, { method: "DELETE" }).then(refreshJobs).catch(alertError);
+          };
+          actions.appendChild(cancel);
+        }
+        var done = job.completed + job.failed;
+        return [
+          cell(job.id),
+          cell(job.state),
+          cell(done + " / " + job.total + (job.failed ? " (" + job.failed + " failed)" : "")),
+          cell(bytes(job.bytes_fetched)),
+          actions,
+        ];
+      });
+    }).catch(function () {});
+  }
+
+  function refreshTop() {
+    api("/api/cache/info?top=10").then(function (info) {
+      fillTable("hosts", info.hosts, function (h) {
+        return [cell(h.name), cell(h.files), cell(bytes(h.bytes))];
+      });
+    }).catch(function () {});
+    api("/api/cache/list?sort=hits&limit=10").then(function (list) {
+      fillTable("urls", list.entries, function (e) {
+        return [cell(e.url || e.filename, "url"), cell(e.hits), cell(bytes(e.size))];
+      });
+    }).catch(function () {});
+  }
+
+  function alertError(err) {
+    alert(err.message);
+  }
+
+  $("login").addEventListener("submit", function (event) {
+    event.preventDefault();
+    localStorage.setItem("tenta-token", $("token").value);
+    $("login").classList.add("hidden");
+    refreshAll();
+  });
+
+  $("purge").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var dryRun = $("purge-dry-run").checked;
+    var query = encodeURIComponent($("purge-by").value) + "=" + encodeURIComponent($("purge-value").value);
+    if (!dryRun && !confirm("Purge " + $("purge-by").value + " " + $("purge-value").value + "?")) {
+      return;
+    }
+    api("/api/cache/purge?" + query + "&dry_run=" + dryRun, { method: "POST" }).then(function (result) {
+      $("purge-result").textContent = (dryRun ? "Would delete " : "Deleted ") +
+        (dryRun ? result.matched : result.deleted) + " entries, " + bytes(result.bytes_freed);
+      if (!dryRun) {
+        refreshTop();
+      }
+    }).catch(function (err) {
+      $("purge-result").textContent = err.message;
+    });
+  });
+
+  $("prefetch").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var urls = $("prefetch-urls").value.split("\n").map(function (u) {
+      return u.trim();
+    }).filter(Boolean);
+    var request = { urls: urls, headers: {} };
+    if ($("prefetch-ua").value) {
+      request.headers["User-Agent"] = $("prefetch-ua").value;
+    }
+    api("/api/prefetch", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(request),
+    }).then(function (job) {
+      $("prefetch-result").textContent = "Started job " + job.id + " with " + job.total + " URLs";
+      $("prefetch-urls").value = "";
+      refreshJobs();
+    }).catch(function (err) {
+      $("prefetch-result").textContent = err.message;
+    });
+  });
+
+  function refreshAll() {
+    refreshStats();
+    refreshDownloads();
+    refreshJobs();
+    refreshTop();
+  }
+
+  refreshAll();
+  setInterval(function () {
+    refreshStats();
+    refreshDownloads();
+    refreshJobs();
+  }, POLL_MS);
+  setInterval(refreshTop, SLOW_POLL_MS);
+})();
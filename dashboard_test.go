@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	saveArgs(t)
+	args.adminTokens = []string{"0123456789abcdef0123"}
+	if err := validateAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		args.adminTokens, adminTokens = nil, nil
+	}()
+
+	mux := http.NewServeMux()
+	registerAPI(mux)
+
+	// The page itself is public, the API behind it is not
+	for path, expected := range map[string]int{
+		"/api/dashboard/":             http.StatusOK,
+		"/api/dashboard/dashboard.js": http.StatusOK,
+		"/api/cache/stats":            http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, w.Code)
+		}
+		if path == "/api/dashboard/" && !strings.Contains(w.Body.String(), "dashboard.js") {
+			t.Errorf("%s: expected the dashboard page, got %s", path, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errDiskSpaceUnsupported is returned by diskSpace where free space can't
+// be measured
+var errDiskSpaceUnsupported = errors.New("free space is not available on this platform")
+
+// spaceThreshold is an amount of disk space, either in bytes or as a
+// percentage of the filesystem
+type spaceThreshold struct {
+	bytes   uint64
+	percent float64
+}
+
+var spaceUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSpaceThreshold parses "10%", "5GB", "512M" or a plain number of
+// bytes. Units are powers of 1024.
+func parseSpaceThreshold(value string) (spaceThreshold, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return spaceThreshold{}, fmt.Errorf("invalid percentage %q", value)
+		}
+		return spaceThreshold{percent: percent}, nil
+	}
+
+	multiplier := uint64(1)
+	for _, unit := range spaceUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return spaceThreshold{}, fmt.Errorf("invalid size %q, expected bytes with an optional K, M, G or T suffix, or a percentage", value)
+	}
+	return spaceThreshold{bytes: uint64(n * float64(multiplier))}, nil
+}
+
+// of returns the threshold in bytes for a filesystem of the given size
+func (t spaceThreshold) of(total uint64) uint64 {
+	if t.percent > 0 {
+		return uint64(float64(total) * t.percent / 100)
+	}
+	return t.bytes
+}
+
+func (t spaceThreshold) String() string {
+	if t.percent > 0 {
+		return strconv.FormatFloat(t.percent, 'g', -1, 64) + "%"
+	}
+	return strconv.FormatUint(t.bytes, 10) + " bytes"
+}
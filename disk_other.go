@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// diskSpace isn't implemented here, free space checks are skipped
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Download is a cache fill in progress
+type Download struct {
+	Key            string    `json:"key"`
+	URL            string    `json:"url"`
+	Client         string    `json:"client"`
+	Source         string    `json:"source"`
+	StartedAt      time.Time `json:"started_at"`
+	Bytes          int64     `json:"bytes"`
+	Size           int64     `json:"size"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+}
+
+// activeDownload tracks one fill. written is advanced by fillCache.
+type activeDownload struct {
+	Download
+	written int64
+}
+
+var downloads = struct {
+	sync.Mutex
+	active map[*activeDownload]struct{}
+}{active: map[*activeDownload]struct{}{}}
+
+// startDownload registers a fill until finish is called
+func startDownload(key string, url string, client string, source string, size int64) *activeDownload {
+	download := &activeDownload{Download: Download{
+		Key:       key,
+		URL:       url,
+		Client:    client,
+		Source:    source,
+		StartedAt: time.Now().UTC(),
+		Size:      size,
+	}}
+
+	downloads.Lock()
+	downloads.active[download] = struct{}{}
+	downloads.Unlock()
+	return download
+}
+
+func (d *activeDownload) finish() {
+	downloads.Lock()
+	delete(downloads.active, d)
+	downloads.Unlock()
+}
+
+// activeDownloads returns the fills in progress, oldest first
+func activeDownloads() []Download {
+	downloads.Lock()
+	list := make([]Download, 0, len(downloads.active))
+	for download := range downloads.active {
+		entry := download.Download
+		entry.Bytes = atomic.LoadInt64(&download.written)
+		if elapsed := time.Since(entry.StartedAt).Seconds(); elapsed > 0 {
+			entry.BytesPerSecond = float64(entry.Bytes) / elapsed
+		}
+		list = append(list, entry)
+	}
+	downloads.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// handleDownloads lists cache fills in progress
+func handleDownloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list := activeDownloads()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":     len(list),
+		"downloads": list,
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published on /api/events
+const (
+	eventHit          = "hit"
+	eventMiss         = "miss"
+	eventFillComplete = "fill-complete"
+	eventEviction     = "eviction"
+	eventPrune        = "prune"
+	eventError        = "error"
+)
+
+var eventTypes = []string{eventHit, eventMiss, eventFillComplete, eventEviction, eventPrune, eventError}
+
+// eventBuffer is how many events a slow subscriber may fall behind before
+// events are dropped for it
+const eventBuffer = 256
+
+// eventHeartbeat keeps idle streams from being closed by proxies and the
+// write idle timeout
+const eventHeartbeat = 15 * time.Second
+
+// Event is something that happened in the cache
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Key     string    `json:"key,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Files   int       `json:"files,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// eventSubscriber is one /api/events stream
+type eventSubscriber struct {
+	events chan Event
+	types  map[string]bool
+	host   string
+}
+
+func (s *eventSubscriber) wants(event Event) bool {
+	if len(s.types) > 0 && !s.types[event.Type] {
+		return false
+	}
+	return s.host == "" || strings.EqualFold(event.Host, s.host)
+}
+
+var eventSubscribers = struct {
+	sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}{subscribers: map[*eventSubscriber]struct{}{}}
+
+// hasEventSubscribers lets callers skip building events nobody will see
+func hasEventSubscribers() bool {
+	eventSubscribers.Lock()
+	defer eventSubscribers.Unlock()
+	return len(eventSubscribers.subscribers) > 0
+}
+
+// publishEvent sends an event to every interested subscriber. It never
+// blocks; subscribers that can't keep up lose events.
+func publishEvent(event Event) {
+	event.Time = time.Now().UTC()
+	if event.Host == "" && event.URL != "" {
+		if u, err := neturl.Parse(event.URL); err == nil {
+			event.Host = u.Host
+		}
+	}
+
+	eventSubscribers.Lock()
+	defer eventSubscribers.Unlock()
+	for subscriber := range eventSubscribers.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+		}
+	}
+}
+
+// publishEviction reports a cache entry being removed. The URL comes from
+// its metadata, so call it before the metadata is deleted.
+func publishEviction(key string, size int64, reason string) {
+	if !hasEventSubscribers() {
+		return
+	}
+	event := Event{Type: eventEviction, Key: key, Size: size, Reason: reason}
+	if meta, err := readMeta(key); err == nil {
+		event.URL = meta.URL
+	}
+	publishEvent(event)
+}
+
+func subscribeEvents(types map[string]bool, host string) *eventSubscriber {
+	subscriber := &eventSubscriber{
+		events: make(chan Event, eventBuffer),
+		types:  types,
+		host:   host,
+	}
+	eventSubscribers.Lock()
+	eventSubscribers.subscribers[subscriber] = struct{}{}
+	eventSubscribers.Unlock()
+	return subscriber
+}
+
+func unsubscribeEvents(subscriber *eventSubscriber) {
+	eventSubscribers.Lock()
+	delete(eventSubscribers.subscribers, subscriber)
+	eventSubscribers.Unlock()
+}
+
+// handleEvents streams events as Server-Sent Events. ?type=hit,miss limits
+// the event types and ?host= the origin host.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Streaming is not supported",
+		})
+		return
+	}
+
+	types := map[string]bool{}
+	for _, value := range r.URL.Query()["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType == "" {
+				continue
+			}
+			known := false
+			for _, t := range eventTypes {
+				known = known || t == eventType
+			}
+			if !known {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": fmt.Sprintf("Unknown event type %q, expected one of %s", eventType, strings.Join(eventTypes, ", ")),
+				})
+				return
+			}
+			types[eventType] = true
+		}
+	}
+
+	subscriber := subscribeEvents(types, r.URL.Query().Get("host"))
+	defer unsubscribeEvents(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-subscriber.events:
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
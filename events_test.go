@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventFilters(t *testing.T) {
+	subscriber := subscribeEvents(map[string]bool{eventHit: true}, "dl.example.com")
+	defer unsubscribeEvents(subscriber)
+
+	publishEvent(Event{Type: eventMiss, URL: "http://dl.example.com/a.pkg"})
+	publishEvent(Event{Type: eventHit, URL: "http://cdn.example.org/b.pkg"})
+	publishEvent(Event{Type: eventHit, URL: "http://dl.example.com/c.pkg"})
+
+	select {
+	case event := <-subscriber.events:
+		if event.URL != "http://dl.example.com/c.pkg" || event.Host != "dl.example.com" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	default:
+		t.Fatal("expected an event")
+	}
+	select {
+	case event := <-subscriber.events:
+		t.Errorf("expected no more events, got %+v", event)
+	default:
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	saveArgs(t)
+	server := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/events?type=eviction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %s", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("expected connected comment, got %q", line)
+	}
+
+	// The subscription is in place once the connected comment arrives
+	args.dataDir = t.TempDir()
+	publishEviction("12345", 10, "purge")
+
+	done := make(chan string)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || strings.HasPrefix(line, "data: ") {
+				done <- line
+				return
+			}
+		}
+	}()
+	select {
+	case line := <-done:
+		if !strings.Contains(line, `"type":"eviction"`) || !strings.Contains(line, `"reason":"purge"`) {
+			t.Errorf("unexpected event %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestEventStreamBadType(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleEvents(w, httptest.NewRequest(http.MethodGet, "/api/events?type=hit,explosion", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
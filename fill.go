@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// internalDir holds tenta's own files inside the data directory. Directory
+// scans skip it since they only look at regular files.
+const internalDir = ".tenta"
+
+// errBodyTooLarge is returned by fillCache when a response of unknown length
+// turns out to be bigger than we cache
+var errBodyTooLarge = errors.New("response exceeds max body size")
+
+// partialDir holds downloads that haven't been committed to the cache yet
+func partialDir() string {
+	return filepath.Join(args.dataDir, internalDir, "partial")
+}
+
+// cleanPartialFiles removes downloads left behind by a previous process
+func cleanPartialFiles() error {
+	if err := os.RemoveAll(partialDir()); err != nil {
+		return err
+	}
+	return os.MkdirAll(partialDir(), 0755)
+}
+
+// backoff returns how long to wait before the given retry attempt
+func backoff(attempt int) time.Duration {
+	delay := time.Duration(args.upstreamRetryBackoff) * time.Millisecond
+	max := time.Duration(args.upstreamRetryMaxBackoff) * time.Millisecond
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// sleepBackoff waits before a retry. It returns false if ctx ends first.
+func sleepBackoff(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fetchWithRetry fetches a cache miss upstream, retrying connection errors
+// with exponential backoff. Each attempt gets its own context so a stalled
+// body only aborts that attempt.
+func fetchWithRetry(ctx context.Context, r *http.Request, url string) (*http.Response, string, error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		resp, source, err := fetchUpstream(attemptCtx, upstreamClient, r, url)
+		if err == nil {
+			limitOriginBody(resp)
+			resp.Body = newStallReader(resp.Body, cancel)
+			return resp, source, nil
+		}
+		cancel()
+
+		if attempt >= args.upstreamRetries || ctx.Err() != nil {
+			return nil, "", err
+		}
+		log.Printf("Error fetching %s (attempt %d of %d), retrying: %s", url, attempt+1, args.upstreamRetries+1, err)
+		incUpstreamRetries()
+		if !sleepBackoff(ctx, attempt) {
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+// canResume reports whether an interrupted response can be continued with a
+// Range request. We need the ETag to make sure we're still getting the same
+// content.
+func canResume(resp *http.Response) bool {
+	return resp.Request != nil &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.Header.Get("ETag") != ""
+}
+
+// resumeUpstream re-requests the remainder of resp from the same upstream,
+// starting at offset. The returned body starts exactly at offset.
+func resumeUpstream(ctx context.Context, resp *http.Response, offset int64) (*http.Response, error) {
+	etag := resp.Header.Get("ETag")
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	req := resp.Request.Clone(attemptCtx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", etag)
+
+	next, err := upstreamClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	limitOriginBody(next)
+	next.Body = newStallReader(next.Body, cancel)
+
+	if next.Header.Get("ETag") != etag {
+		next.Body.Close()
+		return nil, fmt.Errorf("ETag changed from %s to %s", etag, next.Header.Get("ETag"))
+	}
+
+	switch next.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(next.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			next.Body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range %q", next.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// Range was ignored but it's the same content, skip what we have
+		if _, err := io.CopyN(io.Discard, next.Body, offset); err != nil {
+			next.Body.Close()
+			return nil, err
+		}
+	default:
+		next.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d resuming download", next.StatusCode)
+	}
+
+	return next, nil
+}
+
+// fillCache streams an upstream response into a partial file while the
+// client follows along from that file, so a slow client never holds the fill
+// up and a client that goes away doesn't abort it. Interrupted downloads are
+// resumed where possible, and the file is only moved into place once the
+// whole body has arrived. Responses of unknown length are complete at EOF,
+// can't be resumed, and are only cached up to maxSize bytes; the client
+// still gets the rest of a bigger one. The returned func waits for the
+// client to be sent everything it's going to get and must always be called.
+func fillCache(ctx context.Context, data *http.Response, filename string, maxSize int64, client io.Writer, progress *int64) (int64, func(), error) {
+	expected := data.ContentLength
+
+	file, err := os.CreateTemp(partialDir(), filepath.Base(filename)+".*")
+	if err != nil {
+		// Still try to send the data to the client
+		sent, copyErr := io.Copy(client, data.Body)
+		if copyErr != nil {
+			log.Printf("Error creating local file, no data sent: %s", copyErr)
+		}
+		log.Printf("Error creating local file, sent %d bytes: %s", sent, err)
+		return 0, func() {}, err
+	}
+	partial := file.Name()
+	if debugEnabled() {
+		log.Printf("Created partial file %s", partial)
+	}
+
+	follower, err := followFill(partial, client)
+	if err != nil {
+		file.Close()
+		os.Remove(partial)
+		return 0, func() {}, err
+	}
+	clientDone := func() {
+		follower.wait()
+		if follower.err != nil {
+			log.Printf("Client went away while filling %s: %s", filename, follower.err)
+		}
+	}
+
+	abort := func(err error) (int64, func(), error) {
+		follower.finish(false)
+		file.Close()
+		os.Remove(partial)
+		return 0, clientDone, err
+	}
+
+	fill := &fillWriter{file: diskWriter{file}, progress: progress, follower: follower}
+	var written int64
+	var body io.Reader = data.Body
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			limit := expected - written
+			if expected < 0 {
+				// Read one byte past the limit to tell if there's more
+				limit = maxSize + 1 - written
+			}
+			n, err := io.Copy(fill, io.LimitReader(body, limit))
+			written += n
+			if err == nil && expected < 0 && written > maxSize {
+				// Let the client catch up on what's on disk, then hand it
+				// the rest straight from upstream
+				follower.finish(true)
+				follower.wait()
+				file.Close()
+				os.Remove(partial)
+				if follower.err == nil {
+					rest, _ := io.Copy(client, body)
+					if progress != nil {
+						atomic.AddInt64(progress, rest)
+					}
+				}
+				return 0, clientDone, errBodyTooLarge
+			}
+			if err == nil && (expected < 0 || written == expected) {
+				break
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			if fill.fileErr != nil {
+				return abort(fill.fileErr)
+			}
+			lastErr = err
+		}
+
+		if attempt >= args.upstreamRetries || expected < 0 || !canResume(data) || ctx.Err() != nil {
+			return abort(lastErr)
+		}
+		log.Printf("Download of %s interrupted at %d of %d bytes (attempt %d of %d), resuming: %s",
+			filename, written, expected, attempt+1, args.upstreamRetries+1, lastErr)
+		incUpstreamRetries()
+		if !sleepBackoff(ctx, attempt) {
+			return abort(ctx.Err())
+		}
+
+		resumed, err := resumeUpstream(ctx, data, written)
+		if err != nil {
+			log.Printf("Error resuming %s: %s", filename, err)
+			body = nil
+			lastErr = err
+			continue
+		}
+		defer resumed.Body.Close()
+		addResumedBytes(written)
+		body = resumed.Body
+	}
+
+	if err := file.Chmod(0644); err != nil {
+		return abort(err)
+	}
+	if err := file.Close(); err != nil {
+		return abort(err)
+	}
+	// The follower keeps its own handle, so it can finish reading after the
+	// rename
+	follower.finish(true)
+	if err := os.Rename(partial, filename); err != nil {
+		os.Remove(partial)
+		return 0, clientDone, err
+	}
+	return written, clientDone, nil
+}
+
+// fillWriter writes a response into the cache file and lets the client's
+// follower know there's more to send
+type fillWriter struct {
+	file     io.Writer
+	fileErr  error
+	follower *fillFollower
+
+	// progress, if set, is atomically advanced by the bytes written
+	progress *int64
+}
+
+func (f *fillWriter) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	if err != nil {
+		f.fileErr = err
+		return n, err
+	}
+	if f.progress != nil {
+		atomic.AddInt64(f.progress, int64(n))
+	}
+	f.follower.wake()
+	return n, nil
+}
+
+// Follower states, set once by the fill when it's done
+const (
+	followFilling int32 = iota
+	followComplete
+	followFailed
+)
+
+// fillFollower sends a fill to the client from the partial file as it
+// grows. It runs at the client's pace, independent of the fill.
+type fillFollower struct {
+	file   *os.File
+	client io.Writer
+	state  int32
+	more   chan struct{}
+	done   chan struct{}
+
+	// err is the client write error, valid once done is closed
+	err error
+}
+
+// followFill opens the partial file for reading and starts sending it to
+// client
+func followFill(partial string, client io.Writer) (*fillFollower, error) {
+	file, err := os.Open(partial)
+	if err != nil {
+		return nil, err
+	}
+	f := &fillFollower{
+		file:   file,
+		client: client,
+		more:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *fillFollower) run() {
+	defer close(f.done)
+	defer f.file.Close()
+
+	reader := diskReader{f.file}
+	buf := make([]byte, 32*1024)
+	for {
+		// Check before reading: once the fill is complete, EOF is the end
+		state := atomic.LoadInt32(&f.state)
+		if state == followFailed {
+			return
+		}
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, err := f.client.Write(buf[:n]); err != nil {
+				f.err = err
+				return
+			}
+		}
+		if err == io.EOF {
+			if state == followComplete {
+				return
+			}
+			<-f.more
+		} else if err != nil {
+			f.err = err
+			return
+		}
+	}
+}
+
+// wake tells the follower there's more on disk without ever blocking the
+// fill
+func (f *fillFollower) wake() {
+	select {
+	case f.more <- struct{}{}:
+	default:
+	}
+}
+
+// finish tells the follower the fill is over. A complete fill is sent to
+// the end, a failed one is cut off where the client got to.
+func (f *fillFollower) finish(complete bool) {
+	state := followFailed
+	if complete {
+		state = followComplete
+	}
+	atomic.StoreInt32(&f.state, state)
+	f.wake()
+}
+
+func (f *fillFollower) wait() {
+	<-f.done
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupUpstream gets ready to send misses to a test origin through
+// handleRequest or fillCache, caching into the data dir already set
+func setupUpstream(t *testing.T) {
+	saveArgs(t)
+	args.maxBodySize = 1024 * 1024
+	args.upstreamRetries = 0
+	args.upstreamIdleTimeout = 5
+
+	saved := upstreamClient
+	upstreamClient = &http.Client{}
+	t.Cleanup(func() {
+		upstreamClient = saved
+	})
+	if err := cleanPartialFiles(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	saveArgs(t)
+	args.upstreamRetryBackoff = 500
+	args.upstreamRetryMaxBackoff = 3000
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{1, 1 * time.Second},
+		{2, 2 * time.Second},
+		{3, 3 * time.Second},
+		{10, 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		if delay := backoff(test.attempt); delay != test.expected {
+			t.Errorf("attempt %d: expected %s, got %s", test.attempt, test.expected, delay)
+		}
+	}
+}
+
+// TestFillCacheResume verifies that a download cut off part way through is
+// resumed with a Range request and only committed once complete
+func TestFillCacheResume(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	requests := 0
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if requests == 1 {
+			// Promise the whole body, send part of it and hang up
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(payload)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(payload[:25000])
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+
+		if r.Header.Get("Range") != "bytes=25000-" || r.Header.Get("If-Range") != `"v1"` {
+			t.Errorf("unexpected resume headers: Range=%q If-Range=%q", r.Header.Get("Range"), r.Header.Get("If-Range"))
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 25000-%d/%d", len(payload)-1, len(payload)))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(payload)-25000))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[25000:])
+	}))
+	defer origin.Close()
+
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	setupUpstream(t)
+	args.upstreamRetries = 2
+	args.upstreamRetryBackoff = 1
+	args.upstreamRetryMaxBackoff = 1
+
+	resp, err := upstreamClient.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	filename := filepath.Join(args.dataDir, "resumed")
+	client := &bytes.Buffer{}
+	written, clientDone, err := fillCache(context.Background(), resp, filename, int64(len(payload)), client, nil)
+	clientDone()
+	if err != nil {
+		t.Fatalf("fillCache failed: %s", err)
+	}
+
+	if written != int64(len(payload)) {
+		t.Errorf("expected %d bytes written, got %d", len(payload), written)
+	}
+	if !bytes.Equal(client.Bytes(), payload) {
+		t.Errorf("client received %d bytes that don't match the payload", client.Len())
+	}
+	cached, err := os.ReadFile(filename)
+	if err != nil || !bytes.Equal(cached, payload) {
+		t.Errorf("cache file doesn't match the payload: %v", err)
+	}
+	if partials, _ := os.ReadDir(partialDir()); len(partials) != 0 {
+		t.Errorf("expected no partial files left, found %d", len(partials))
+	}
+}
+
+// TestFillCacheUnknownLength verifies that chunked responses are read to EOF
+// and only cached when they fit within the max body size
+func TestFillCacheUnknownLength(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the body is done makes the response chunked
+		w.Write(payload[:25000])
+		w.(http.Flusher).Flush()
+		w.Write(payload[25000:])
+	}))
+	defer origin.Close()
+
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	setupUpstream(t)
+	args.upstreamRetries = 2
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		cached  bool
+	}{
+		{"fits", int64(len(payload)), true},
+		{"too large", int64(len(payload)) - 1, false},
+	}
+
+	for _, test := range tests {
+		resp, err := upstreamClient.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != -1 {
+			t.Fatalf("expected a chunked response, got Content-Length %d", resp.ContentLength)
+		}
+
+		filename := filepath.Join(args.dataDir, "chunked")
+		client := &bytes.Buffer{}
+		written, clientDone, err := fillCache(context.Background(), resp, filename, test.maxSize, client, nil)
+		clientDone()
+		resp.Body.Close()
+
+		if test.cached && (err != nil || written != int64(len(payload))) {
+			t.Errorf("%s: expected %d bytes cached, got %d: %v", test.name, len(payload), written, err)
+		}
+		if !test.cached && err != errBodyTooLarge {
+			t.Errorf("%s: expected errBodyTooLarge, got %v", test.name, err)
+		}
+		if !bytes.Equal(client.Bytes(), payload) {
+			t.Errorf("%s: client received %d bytes that don't match the payload", test.name, client.Len())
+		}
+		if _, err := os.Stat(filename); os.IsNotExist(err) == test.cached {
+			t.Errorf("%s: expected cached=%t, stat returned %v", test.name, test.cached, err)
+		}
+		os.Remove(filename)
+	}
+	if partials, _ := os.ReadDir(partialDir()); len(partials) != 0 {
+		t.Errorf("expected no partial files left, found %d", len(partials))
+	}
+}
+
+// blockedWriter is a client that doesn't read anything until released
+type blockedWriter struct {
+	release chan struct{}
+	bytes.Buffer
+}
+
+func (b *blockedWriter) Write(p []byte) (int, error) {
+	<-b.release
+	return b.Buffer.Write(p)
+}
+
+// TestFillCacheSlowClient verifies that the fill runs at upstream speed
+// while a stalled client catches up from the partial file afterwards
+func TestFillCacheSlowClient(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(payload)))
+		w.Write(payload)
+	}))
+	defer origin.Close()
+
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	setupUpstream(t)
+
+	resp, err := upstreamClient.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	filename := filepath.Join(args.dataDir, "slow")
+	client := &blockedWriter{release: make(chan struct{})}
+	written, clientDone, err := fillCache(context.Background(), resp, filename, int64(len(payload)), client, nil)
+	if err != nil || written != int64(len(payload)) {
+		t.Fatalf("expected the fill to finish without the client, got %d bytes: %v", written, err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("expected the file to be cached before the client caught up: %s", err)
+	}
+
+	close(client.release)
+	clientDone()
+	if !bytes.Equal(client.Bytes(), payload) {
+		t.Errorf("client received %d bytes that don't match the payload", client.Len())
+	}
+}
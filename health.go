@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// resolverCheckInterval is how long a resolver check result is reused, so
+// frequent probes don't turn into a stream of DNS queries
+const resolverCheckInterval = 10 * time.Second
+
+// dataDirCheckInterval is how long a data dir write check result is reused
+const dataDirCheckInterval = 5 * time.Second
+
+// resolverTimeout bounds each resolver check
+const resolverTimeout = 2 * time.Second
+
+// readyMinFree is --ready-min-free, parsed by validateConfig
+var readyMinFree spaceThreshold
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// ReadinessStatus is the response of /api/readyz
+type ReadinessStatus struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+var dataDirCheck = struct {
+	sync.Mutex
+	dir     string
+	result  HealthCheck
+	checked time.Time
+}{}
+
+// checkDataDirWritable creates and removes a file next to tenta's own
+// files. The result is reused like the resolver check, so frequent probes
+// don't turn into a stream of writes.
+func checkDataDirWritable() HealthCheck {
+	dataDirCheck.Lock()
+	defer dataDirCheck.Unlock()
+	if dataDirCheck.dir == args.dataDir && time.Since(dataDirCheck.checked) < dataDirCheckInterval {
+		return dataDirCheck.result
+	}
+
+	check := HealthCheck{Name: "data_dir_writable", OK: true}
+	if err := probeDataDir(filepath.Join(args.dataDir, internalDir)); err != nil {
+		check.OK = false
+		check.Message = err.Error()
+	}
+
+	dataDirCheck.dir = args.dataDir
+	dataDirCheck.result = check
+	dataDirCheck.checked = time.Now()
+	return check
+}
+
+func probeDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, "readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write([]byte("ok")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkFreeSpace compares free space in the data dir against --ready-min-free
+func checkFreeSpace() HealthCheck {
+	check := HealthCheck{Name: "free_space"}
+	free, total, err := diskSpace(args.dataDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		check.OK = true
+		check.Message = err.Error()
+		return check
+	}
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+
+	min := readyMinFree.of(total)
+	check.OK = free >= min
+	check.Message = fmt.Sprintf("%d of %d bytes free, minimum %s", free, total, readyMinFree)
+	return check
+}
+
+// checkInitialScan waits for the cache index to be loaded, or rebuilt
+func checkInitialScan() HealthCheck {
+	check := HealthCheck{Name: "initial_scan", OK: isScanComplete()}
+	if !check.OK {
+		check.Message = "cache index still loading"
+	}
+	return check
+}
+
+var resolverCheck = struct {
+	sync.Mutex
+	result  HealthCheck
+	checked time.Time
+}{}
+
+// checkResolver asks the upstream resolvers for the root name servers. Any
+// answer, even an error from the server, shows it is reachable.
+func checkResolver() HealthCheck {
+	resolverCheck.Lock()
+	defer resolverCheck.Unlock()
+	if time.Since(resolverCheck.checked) < resolverCheckInterval {
+		return resolverCheck.result
+	}
+
+	check := HealthCheck{Name: "upstream_resolver"}
+	errs := []string{}
+	for _, server := range args.dnsResolvers {
+		if err := probeResolver(server); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		check.OK = true
+		check.Message = server + " answered"
+		break
+	}
+	if !check.OK {
+		check.Message = fmt.Sprintf("no resolver answered: %v", errs)
+	}
+
+	resolverCheck.result = check
+	resolverCheck.checked = time.Now()
+	return check
+}
+
+func probeResolver(server string) error {
+	dialer := &net.Dialer{Timeout: resolverTimeout}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolverTimeout)
+	defer cancel()
+
+	_, err := resolver.LookupNS(ctx, ".")
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !dnsErr.IsTimeout && !dnsErr.IsTemporary {
+		// The server answered, just not with records
+		return nil
+	}
+	return err
+}
+
+// readinessChecks runs every check, the slow ones concurrently
+func readinessChecks() []HealthCheck {
+	checks := []func() HealthCheck{checkDataDirWritable, checkFreeSpace, checkInitialScan, checkResolver}
+	results := make([]HealthCheck, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() HealthCheck) {
+			defer wg.Done()
+			results[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+func isReady(checks []HealthCheck) bool {
+	for _, check := range checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// handleLivez reports that the process is up and serving requests. It
+// checks nothing else, so a full disk doesn't get tenta restarted.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "alive",
+		"uptime": time.Since(startTime).String(),
+	})
+}
+
+// handleReadyz reports whether tenta can serve traffic, with the result of
+// each check. It returns 503 until every check passes.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := ReadinessStatus{Status: "ready", Checks: readinessChecks()}
+	if !isReady(status.Checks) {
+		status.Status = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
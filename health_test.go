@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSpaceThreshold(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected spaceThreshold
+		valid    bool
+	}{
+		{"10%", spaceThreshold{percent: 10}, true},
+		{"0.5%", spaceThreshold{percent: 0.5}, true},
+		{"1048576", spaceThreshold{bytes: 1 << 20}, true},
+		{"512M", spaceThreshold{bytes: 512 << 20}, true},
+		{"5GB", spaceThreshold{bytes: 5 << 30}, true},
+		{"1.5k", spaceThreshold{bytes: 1536}, true},
+		{"101%", spaceThreshold{}, false},
+		{"-1G", spaceThreshold{}, false},
+		{"lots", spaceThreshold{}, false},
+	}
+	for _, test := range tests {
+		threshold, err := parseSpaceThreshold(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%t, got %v", test.value, test.valid, err)
+			continue
+		}
+		if threshold != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.expected, threshold)
+		}
+	}
+
+	if got := (spaceThreshold{percent: 10}).of(1000); got != 100 {
+		t.Errorf("expected 10%% of 1000 to be 100, got %d", got)
+	}
+}
+
+// fakeResolverCheck stands in for the DNS probe until the test ends
+func fakeResolverCheck(t *testing.T, ok bool) {
+	resolverCheck.Lock()
+	resolverCheck.result = HealthCheck{Name: "upstream_resolver", OK: ok}
+	resolverCheck.checked = time.Now().Add(time.Hour)
+	resolverCheck.Unlock()
+	t.Cleanup(func() {
+		resolverCheck.Lock()
+		resolverCheck.checked = time.Time{}
+		resolverCheck.Unlock()
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	readyMinFree = spaceThreshold{}
+	fakeResolverCheck(t, true)
+	atomic.StoreInt32(&scanComplete, 0)
+	defer atomic.StoreInt32(&scanComplete, 1)
+
+	readyz := func() (int, ReadinessStatus) {
+		w := httptest.NewRecorder()
+		handleReadyz(w, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+		var status ReadinessStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, status
+	}
+
+	code, status := readyz()
+	if code != http.StatusServiceUnavailable || status.Status != "not_ready" {
+		t.Errorf("expected 503 not_ready during the scan, got %d %s", code, status.Status)
+	}
+	for _, check := range status.Checks {
+		if check.OK == (check.Name == "initial_scan") {
+			t.Errorf("unexpected result for %s: %+v", check.Name, check)
+		}
+	}
+
+	atomic.StoreInt32(&scanComplete, 1)
+	if code, status = readyz(); code != http.StatusOK || status.Status != "ready" {
+		t.Errorf("expected 200 ready, got %d %+v", code, status)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(args.dataDir, internalDir)); len(entries) != 0 {
+		t.Errorf("expected the write check to clean up, found %d files", len(entries))
+	}
+
+	// The write check is reused for a while, then notices the data dir broke
+	os.RemoveAll(filepath.Join(args.dataDir, internalDir))
+	if err := os.WriteFile(filepath.Join(args.dataDir, internalDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := checkDataDirWritable(); !check.OK {
+		t.Errorf("expected the recent result to be reused, got %+v", check)
+	}
+	dataDirCheck.Lock()
+	dataDirCheck.checked = time.Time{}
+	dataDirCheck.Unlock()
+	if check := checkDataDirWritable(); check.OK {
+		t.Errorf("expected an unwritable data dir to fail the check once it's rerun, got %+v", check)
+	}
+	os.Remove(filepath.Join(args.dataDir, internalDir))
+	dataDirCheck.Lock()
+	dataDirCheck.checked = time.Time{}
+	dataDirCheck.Unlock()
+
+	readyMinFree = spaceThreshold{percent: 100}
+	code, _ = readyz()
+	readyMinFree = spaceThreshold{}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with no free space to spare, got %d", code)
+	}
+
+	fakeResolverCheck(t, false)
+	if code, _ = readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with no resolver, got %d", code)
+	}
+}
+
+func TestLivez(t *testing.T) {
+	saveArgs(t)
+	args.dataDir = filepath.Join(t.TempDir(), "missing")
+	w := httptest.NewRecorder()
+	handleLivez(w, httptest.NewRequest(http.MethodGet, "/api/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestProbeResolver(t *testing.T) {
+	if err := probeResolver("127.0.0.1:1"); err == nil {
+		t.Error("expected a resolver on a closed port to be unreachable")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherHosts is the host label for traffic from hosts without their own
+const otherHosts = "other"
+
+// hostCandidates bounds how many hosts are counted while waiting for a label
+// slot. When it fills up the counts start over.
+const hostCandidates = 1000
+
+// hostAdmitRequests is how many requests a host needs before it gets its own
+// label, so one-off hosts don't take slots from busy ones
+const hostAdmitRequests = 10
+
+var (
+	tentaHostRequests  *prometheus.CounterVec
+	tentaHostResponses *prometheus.CounterVec
+	tentaHostBytes     *prometheus.CounterVec
+)
+
+func init() {
+	tentaHostRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenta_host_requests_total",
+		Help: "The total number of proxied requests by origin host or key rule, and cache status",
+	}, []string{"host", "cache_status"})
+	tentaHostResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenta_host_responses_total",
+		Help: "The total number of proxied responses by origin host or key rule, and status code",
+	}, []string{"host", "code"})
+	tentaHostBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenta_host_bytes_total",
+		Help: "The total number of bytes sent to clients by origin host or key rule, and where they came from",
+	}, []string{"host", "source"})
+}
+
+// metricHosts decides which hosts get their own label. Hosts from
+// --metrics-hosts always do; after that the first --metrics-max-hosts hosts
+// to reach hostAdmitRequests requests are added and keep their label.
+// Everything else is counted as "other".
+var metricHosts = struct {
+	sync.Mutex
+	labeled    map[string]bool
+	admitted   int
+	candidates map[string]int
+}{labeled: map[string]bool{}, candidates: map[string]int{}}
+
+// resetMetricHosts applies --metrics-hosts and forgets admitted hosts
+func resetMetricHosts() {
+	metricHosts.Lock()
+	defer metricHosts.Unlock()
+	metricHosts.labeled = map[string]bool{}
+	metricHosts.admitted = 0
+	metricHosts.candidates = map[string]int{}
+	for _, host := range args.metricsHosts {
+		metricHosts.labeled[strings.ToLower(host)] = true
+	}
+}
+
+// metricHost returns the label for a request's origin. Requests matched by
+// a key rule are labeled with the rule's name, since rules like Steam's
+// spread one profile over many CDN hosts. Only requests counted with admit
+// set bring a host closer to its own label.
+func metricHost(r *http.Request, admit bool) string {
+	if rule, ok := matchKeyRule(r); ok && rule.Name != "" {
+		return rule.Name
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return otherHosts
+	}
+
+	metricHosts.Lock()
+	defer metricHosts.Unlock()
+	if metricHosts.labeled[host] {
+		return host
+	}
+	if !admit || metricHosts.admitted >= args.metricsMaxHosts {
+		return otherHosts
+	}
+
+	if len(metricHosts.candidates) >= hostCandidates {
+		metricHosts.candidates = map[string]int{}
+	}
+	metricHosts.candidates[host]++
+	if metricHosts.candidates[host] < hostAdmitRequests {
+		return otherHosts
+	}
+	delete(metricHosts.candidates, host)
+	metricHosts.labeled[host] = true
+	metricHosts.admitted++
+	return host
+}
+
+// observeHostMetrics counts a finished proxy request. Requests the cache
+// didn't handle, like API calls, have no cache status and are skipped.
+func observeHostMetrics(r *http.Request, cacheStatus string, status int, bytes int64) {
+	if cacheStatus == "" {
+		return
+	}
+
+	host := metricHost(r, true)
+	tentaHostRequests.WithLabelValues(host, strings.ToLower(cacheStatus)).Inc()
+	tentaHostResponses.WithLabelValues(host, strconv.Itoa(status)).Inc()
+
+	source := "origin"
+	if cacheStatus == cacheStatusHit || cacheStatus == cacheStatusStale {
+		source = "cache"
+	}
+	tentaHostBytes.WithLabelValues(host, source).Add(float64(bytes))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHostMetrics(t *testing.T) {
+	saveArgs(t)
+	args.metricsHosts = []string{"Always.example.com"}
+	args.metricsMaxHosts = 1
+	resetMetricHosts()
+	defer func() {
+		args.metricsHosts = nil
+		resetMetricHosts()
+	}()
+
+	// Other tests count toward "other" as well
+	otherBefore := testutil.ToFloat64(tentaHostRequests.WithLabelValues(otherHosts, "miss"))
+
+	status := cacheStatusMiss
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setCacheStatus(r, "12345", status)
+		w.Write([]byte("0123456789"))
+	}))
+	request := func(host string, userAgent string) {
+		r := httptest.NewRequest(http.MethodGet, "/file", nil)
+		r.Host = host
+		r.Header.Set("User-Agent", userAgent)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	for i := 0; i < hostAdmitRequests; i++ {
+		request("busy.example.com:80", "")
+		request("late.example.com", "")
+	}
+	status = cacheStatusHit
+	request("always.example.com", "")
+	request("content1.steampowered.com", "Valve/Steam HTTP Client 1.0")
+	request("busy.example.com", "")
+
+	tests := []struct {
+		name     string
+		host     string
+		status   string
+		expected float64
+	}{
+		{"first host to get busy gets the slot", "busy.example.com", "miss", 1},
+		{"no slots left", "late.example.com", "miss", 0},
+		{"no slots left", otherHosts, "miss", hostAdmitRequests*2 - 1},
+		{"configured hosts always have a label", "always.example.com", "hit", 1},
+		{"key rules label by name", "steam", "hit", 1},
+	}
+	for _, test := range tests {
+		got := testutil.ToFloat64(tentaHostRequests.WithLabelValues(test.host, test.status))
+		if test.host == otherHosts {
+			got -= otherBefore
+		}
+		if got != test.expected {
+			t.Errorf("%s: %s %s = %v, expected %v", test.name, test.host, test.status, got, test.expected)
+		}
+	}
+
+	if got := testutil.ToFloat64(tentaHostBytes.WithLabelValues("busy.example.com", "cache")); got != 10 {
+		t.Errorf("expected 10 bytes from cache for busy.example.com, got %v", got)
+	}
+	if got := testutil.ToFloat64(tentaHostBytes.WithLabelValues("busy.example.com", "origin")); got != 10 {
+		t.Errorf("expected 10 bytes from origin for busy.example.com, got %v", got)
+	}
+	if got := testutil.ToFloat64(tentaHostResponses.WithLabelValues("steam", "200")); got != 1 {
+		t.Errorf("expected one 200 for steam, got %v", got)
+	}
+
+	// API calls have no cache status and aren't counted
+	api := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/api/health", nil)
+	r.Host = "always.example.com"
+	api.ServeHTTP(httptest.NewRecorder(), r)
+	if got := testutil.ToFloat64(tentaHostResponses.WithLabelValues("always.example.com", "200")); got != 1 {
+		t.Errorf("expected API calls to be skipped, got %v", got)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -16,15 +18,20 @@ import (
 
 // CacheStats represents cache statistics
 type CacheStats struct {
-	TotalRequests  int64   `json:"total_requests"`
-	CacheHits      int64   `json:"cache_hits"`
-	CacheMisses    int64   `json:"cache_misses"`
-	HitRatio       float64 `json:"hit_ratio"`
-	NotFound       int64   `json:"not_found_404"`
-	ServerErrors   int64   `json:"server_errors_5xx"`
-	OtherErrors    int64   `json:"other_errors"`
-	FileCount      int64   `json:"file_count"`
-	CacheSize      int64   `json:"cache_size_bytes"`
+	TotalRequests int64   `json:"total_requests"`
+	CacheHits     int64   `json:"cache_hits"`
+	CacheMisses   int64   `json:"cache_misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	NotFound      int64   `json:"not_found_404"`
+	ServerErrors  int64   `json:"server_errors_5xx"`
+	OtherErrors   int64   `json:"other_errors"`
+	FileCount     int64   `json:"file_count"`
+	CacheSize     int64   `json:"cache_size_bytes"`
+	BytesServed   int64   `json:"bytes_served"`
+	PassThrough   bool    `json:"pass_through"`
+
+	Counters  CounterTotals    `json:"counters"`
+	Bandwidth BandwidthSavings `json:"bandwidth"`
 }
 
 // HealthStatus represents service health information
@@ -36,19 +43,7 @@ type HealthStatus struct {
 	CacheSize    int64  `json:"cache_size_bytes"`
 	MaxCacheAge  int    `json:"max_cache_age_hours"`
 	CronSchedule string `json:"cron_schedule"`
-}
-
-// CacheEntry represents a single cached file
-type CacheEntry struct {
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	ModTime  string `json:"mod_time"`
-}
-
-// CacheListResponse represents the response for listing cache entries
-type CacheListResponse struct {
-	Count   int           `json:"count"`
-	Entries []CacheEntry  `json:"entries"`
+	PassThrough  bool   `json:"pass_through"`
 }
 
 var startTime = time.Now()
@@ -57,14 +52,20 @@ var startTime = time.Now()
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	status := "healthy"
+	if !isReady(readinessChecks()) {
+		status = "unhealthy"
+	}
+
 	health := HealthStatus{
-		Status:       "healthy",
+		Status:       status,
 		Uptime:       time.Since(startTime).String(),
 		DataDir:      args.dataDir,
 		CacheFiles:   getFilesCount(),
 		CacheSize:    getSizeCount(),
 		MaxCacheAge:  args.maxCacheAge,
 		CronSchedule: args.cronSchedule,
+		PassThrough:  isPassThroughMode(),
 	}
 
 	json.NewEncoder(w).Encode(health)
@@ -96,45 +97,15 @@ func handleCacheStats(w http.ResponseWriter, r *http.Request) {
 		OtherErrors:   otherErrors,
 		FileCount:     getFilesCount(),
 		CacheSize:     getSizeCount(),
+		BytesServed:   getBytesServed(),
+		PassThrough:   isPassThroughMode(),
+		Counters:      getCounters(),
+		Bandwidth:     getSavings(),
 	}
 
 	json.NewEncoder(w).Encode(stats)
 }
 
-// handleCacheList lists all cached items
-func handleCacheList(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	files, err := os.ReadDir(args.dataDir)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": fmt.Sprintf("Error reading cache dir: %s", err.Error()),
-		})
-		incErrors()
-		return
-	}
-
-	entries := []CacheEntry{}
-	for _, file := range files {
-		if !file.IsDir() {
-			fileInfo, _ := file.Info()
-			entries = append(entries, CacheEntry{
-				Filename: file.Name(),
-				Size:     fileInfo.Size(),
-				ModTime:  fileInfo.ModTime().String(),
-			})
-		}
-	}
-
-	response := CacheListResponse{
-		Count:   len(entries),
-		Entries: entries,
-	}
-
-	json.NewEncoder(w).Encode(response)
-}
-
 // handleCacheDelete handles cache deletion
 func handleCacheDelete(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -164,7 +135,7 @@ func handleCacheDelete(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		file, err := os.Stat(filename)
+		entry, err := indexGet(key)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(map[string]string{
@@ -173,7 +144,7 @@ func handleCacheDelete(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := os.Remove(filename); err != nil {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{
 				"error": fmt.Sprintf("Failed to delete cache entry: %s", err.Error()),
@@ -182,22 +153,24 @@ func handleCacheDelete(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		subSize(file.Size())
+		subSize(entry.Size)
 		decFiles()
+		publishEviction(key, entry.Size, "delete")
+		deleteMeta(key)
 		log.Printf("Deleted cache entry: %s", key)
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "deleted",
 			"key":    key,
-			"size":   file.Size(),
+			"size":   entry.Size,
 		})
 	} else {
 		// Delete all cache entries
-		files, err := os.ReadDir(args.dataDir)
+		entries, err := indexEntries()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{
-				"error": fmt.Sprintf("Error reading cache dir: %s", err.Error()),
+				"error": fmt.Sprintf("Error reading cache index: %s", err.Error()),
 			})
 			incErrors()
 			return
@@ -205,29 +178,239 @@ func handleCacheDelete(w http.ResponseWriter, r *http.Request) {
 
 		deleted := 0
 		var totalSize int64
-		for _, file := range files {
-			if !file.IsDir() {
-				fileInfo, _ := file.Info()
-				fullPath := filepath.Join(args.dataDir, file.Name())
-				if err := os.Remove(fullPath); err != nil {
-					log.Printf("Error deleting %s: %s", fullPath, err)
-					incErrors()
-					continue
-				}
-				subSize(fileInfo.Size())
-				decFiles()
-				totalSize += fileInfo.Size()
-				deleted++
+		for _, entry := range entries {
+			fullPath := filepath.Join(args.dataDir, entry.Key)
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error deleting %s: %s", fullPath, err)
+				incErrors()
+				continue
 			}
+			subSize(entry.Size)
+			decFiles()
+			publishEviction(entry.Key, entry.Size, "delete")
+			deleteMeta(entry.Key)
+			totalSize += entry.Size
+			deleted++
 		}
 
 		log.Printf("Cleared entire cache: deleted %d files", deleted)
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":      "cleared",
-			"deleted":     deleted,
-			"size_freed":  totalSize,
+			"status":     "cleared",
+			"deleted":    deleted,
+			"size_freed": totalSize,
+		})
+	}
+}
+
+// CacheLookupResponse describes what the cache holds for a URL
+type CacheLookupResponse struct {
+	URL        string      `json:"url"`
+	CacheKey   string      `json:"cache_key"`
+	Key        string      `json:"key"`
+	Cached     bool        `json:"cached"`
+	Size       int64       `json:"size,omitempty"`
+	StoredAt   string      `json:"stored_at,omitempty"`
+	AgeSeconds int64       `json:"age_seconds,omitempty"`
+	Fresh      *bool       `json:"fresh,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
+}
+
+// handleCacheLookup answers "is this URL cached?" using the same key
+// generation as the proxy itself
+func handleCacheLookup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "url parameter is required",
+		})
+		return
+	}
+
+	keyRequest, err := newKeyRequest(rawURL, r.URL.Query().Get("ua"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Invalid url: %s", err.Error()),
 		})
+		return
+	}
+
+	url := generateURL(keyRequest)
+	cacheKey := generateCacheKey(url, keyRequest)
+	response := CacheLookupResponse{
+		URL:      url,
+		CacheKey: cacheKey,
+		Key:      hashCacheKey(cacheKey),
+	}
+
+	entry, err := indexGet(response.Key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Error checking cache entry: %s", err.Error()),
+			})
+			incErrors()
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+		return
 	}
+
+	response.Cached = true
+	response.Size = entry.Size
+
+	// Entries cached before metadata was recorded only have the file
+	if !entry.NoMeta {
+		fresh := entry.isFresh()
+		response.Fresh = &fresh
+		response.Headers = entry.Header
+	}
+	response.StoredAt = entry.StoredAt.UTC().Format(time.RFC3339)
+	response.AgeSeconds = int64(time.Since(entry.StoredAt).Seconds())
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleLimits reports and updates the bandwidth limits at runtime. A PUT
+// or POST body only needs the fields being changed.
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		limits := currentBandwidth()
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Invalid limits: %s", err.Error()),
+			})
+			return
+		}
+		if err := validateBandwidth(limits); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+		configureBandwidth(limits)
+		log.Printf("Bandwidth limits updated: origin=%d, originHost=%d, client=%d, hitPriority=%t",
+			limits.Origin, limits.OriginHost, limits.Client, limits.HitPriority)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only GET, PUT and POST methods allowed",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(currentBandwidth())
+}
+
+// handleClients lists per-client statistics, busiest first
+func handleClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "limit must be a non-negative integer",
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	list := topClients(limit)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(list),
+		"clients": list,
+	})
+}
+
+// apiRoutes are the admin API endpoints
+var apiRoutes = map[string]http.HandlerFunc{
+	"/api/health":            handleHealth,
+	"/api/livez":             handleLivez,
+	"/api/readyz":            handleReadyz,
+	"/api/cache/stats":       handleCacheStats,
+	"/api/cache/stats/reset": handleCountersReset,
+	"/api/cache/list":        handleCacheList,
+	"/api/cache/info":        handleCacheInfo,
+	"/api/cache/lookup":      handleCacheLookup,
+	"/api/cache/purge":       handleCachePurge,
+	"/api/cache/delete":      handleCacheDelete,
+	"/api/cache/delete/":     handleCacheDelete,
+	"/api/limits":            handleLimits,
+	"/api/clients":           handleClients,
+	"/api/downloads":         handleDownloads,
+	"/api/events":            handleEvents,
+	"/api/prefetch":          handlePrefetch,
+	"/api/prefetch/":         handlePrefetchJob,
+	dashboardPath:            dashboardHandler().ServeHTTP,
+}
+
+// registerAPI adds the admin API, behind authentication, to a mux
+func registerAPI(mux *http.ServeMux) {
+	for path, handler := range apiRoutes {
+		mux.Handle(path, withAdminAuth(handler))
+	}
+}
+
+// startAdmin serves the admin API on --admin-addr, over TLS when a
+// certificate is configured
+func startAdmin() *http.Server {
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	if metricsOnAdmin() {
+		mux.Handle(args.metricsPath, withAdminAuth(metricsHandler()))
+		log.Printf("Serving metrics on the admin API at %s", args.metricsPath)
+	}
+	mux.HandleFunc("/", redirectToDashboard)
+
+	s := &http.Server{
+		Addr:              args.adminAddr,
+		Handler:           withClientIP(withAccessLog(mux)),
+		ReadHeaderTimeout: time.Duration(args.serverReadHeaderTimeout) * time.Second,
+		IdleTimeout:       time.Duration(args.serverIdleTimeout) * time.Second,
+		MaxHeaderBytes:    1 << 20,
+	}
+
+	if args.adminTLSCert != "" {
+		config, err := adminTLSConfig()
+		if err != nil {
+			log.Fatalf("admin TLS: %s\n", err)
+		}
+		s.TLSConfig = config
+	}
+
+	listener, err := net.Listen("tcp", args.adminAddr)
+	if err != nil {
+		log.Fatalf("admin listen: %s\n", err)
+	}
+
+	go func() {
+		var err error
+		if args.adminTLSCert != "" {
+			log.Printf("Starting admin API on %s (TLS)", args.adminAddr)
+			err = s.ServeTLS(listener, args.adminTLSCert, args.adminTLSKey)
+		} else {
+			log.Printf("Starting admin API on %s", args.adminAddr)
+			err = s.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("admin listen: %s\n", err)
+		}
+	}()
+	return s
 }
 
 func StartHTTP() {
@@ -236,32 +419,55 @@ func StartHTTP() {
 	// Create a mux for routing incoming requests
 	myHandler := http.NewServeMux()
 
-	// API endpoints
-	myHandler.HandleFunc("/api/health", handleHealth)
-	myHandler.HandleFunc("/api/cache/stats", handleCacheStats)
-	myHandler.HandleFunc("/api/cache/list", handleCacheList)
-	myHandler.HandleFunc("/api/cache/delete", handleCacheDelete)
-	myHandler.HandleFunc("/api/cache/delete/", handleCacheDelete)
+	if args.adminAddr == "" {
+		registerAPI(myHandler)
+	} else {
+		// Only health probes stay on the proxy port, other /api/ paths are
+		// proxied like any other
+		myHandler.HandleFunc("/api/health", handleHealth)
+		myHandler.HandleFunc("/api/livez", handleLivez)
+		myHandler.HandleFunc("/api/readyz", handleReadyz)
+	}
+	if !adminAuthEnabled() {
+		log.Print("Admin API has no authentication, set --admin-token or --admin-client-ca to require it")
+	}
 
 	// Proxy endpoint (all other paths)
 	myHandler.HandleFunc("/", handleRequest)
 
+	// There is deliberately no ReadTimeout or WriteTimeout: either would
+	// cut off large downloads. Stalled clients are handled per write instead.
 	s := &http.Server{
-		Addr:           port,
-		Handler:        myHandler,
-		ReadTimeout:    60 * time.Second,
-		WriteTimeout:   60 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              port,
+		Handler:           withWriteIdleTimeout(withClientIP(withAccessLog(withTracing(myHandler)))),
+		ReadHeaderTimeout: time.Duration(args.serverReadHeaderTimeout) * time.Second,
+		IdleTimeout:       time.Duration(args.serverIdleTimeout) * time.Second,
+		MaxHeaderBytes:    1 << 20,
+		ConnContext:       saveConnInContext,
 	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatalf("listen: %s\n", err)
+	}
+	if args.proxyProtocol {
+		log.Printf("Accepting PROXY protocol headers on %s", port)
+		listener = &proxyProtoListener{Listener: listener}
+	}
+
 	go func() {
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
+
+	var admin *http.Server
+	if args.adminAddr != "" {
+		admin = startAdmin()
+	}
 	log.Print("Server Started")
 
 	<-done
@@ -273,8 +479,18 @@ func StartHTTP() {
 		cancel()
 	}()
 
+	// Downloads still running after the timeout are cut off rather than
+	// exiting, so the caller can still save state on the way out
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Printf("Admin API Shutdown Failed, closing it: %+v", err)
+			admin.Close()
+		}
+	}
 	if err := s.Shutdown(ctx); err != nil {
-		log.Fatalf("Server Shutdown Failed:%+v", err)
+		log.Printf("Server Shutdown Failed, closing remaining connections: %+v", err)
+		s.Close()
+		return
 	}
 	log.Print("Server Exited Properly")
 }
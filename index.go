@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexRebuildBatch is how many files a rebuild indexes per transaction,
+// so fills aren't held up for the whole rebuild
+const indexRebuildBatch = 1000
+
+// indexScanBatch is how many entries indexScan reads per transaction, so
+// none stays open while a slow client is sent what was read
+const indexScanBatch = 1000
+
+// The index keeps one bucket of entries by key, buckets of keys ordered by
+// last access for eviction and by other values for listings, and running
+// totals of files and bytes
+var (
+	entriesBucket  = []byte("entries")
+	lruBucket      = []byte("lru")
+	bySizeBucket   = []byte("by_size")
+	byStoredBucket = []byte("by_stored")
+	byHitsBucket   = []byte("by_hits")
+	stateBucket    = []byte("state")
+
+	cleanKey = []byte("clean")
+	filesKey = []byte("files")
+	sizeKey  = []byte("size")
+)
+
+// orderBuckets hold every entry key ordered by a value. Their keys are the
+// value, 8 bytes big endian, followed by the entry key.
+var orderBuckets = []struct {
+	name  []byte
+	value func(e *indexEntry) int64
+}{
+	{lruBucket, func(e *indexEntry) int64 { return e.lastAccess().UnixNano() }},
+	{bySizeBucket, func(e *indexEntry) int64 { return e.Size }},
+	{byStoredBucket, func(e *indexEntry) int64 { return e.StoredAt.UnixNano() }},
+	{byHitsBucket, func(e *indexEntry) int64 { return e.Hits }},
+}
+
+// errIndexClosed is returned while the index isn't open: before StartIndex
+// and once it has been closed on shutdown
+var errIndexClosed = errors.New("cache index is closed")
+
+// indexPosition is where an entry sits in an order: its value there, which
+// is 0 when ordered by key, and its key
+type indexPosition struct {
+	Value int64
+	Key   string
+}
+
+// indexEntry is what the index records about a cache file. Files cached by
+// releases that didn't keep metadata only have their key, size and time.
+type indexEntry struct {
+	CacheMeta
+	NoMeta bool `json:"no_meta,omitempty"`
+}
+
+// index is the open index of the data dir, opened by StartIndex and closed
+// on shutdown. Metadata sidecars stay the source it is rebuilt from.
+var index = struct {
+	sync.Mutex
+	db *bolt.DB
+}{}
+
+func indexPath() string {
+	return filepath.Join(args.dataDir, internalDir, "index.db")
+}
+
+// openIndex opens the index of the data dir and reports whether it has to
+// be rebuilt: because it's new or damaged, or tenta didn't shut down
+// cleanly and files may have changed without it. Callers hold index.
+func openIndex() (*bolt.DB, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(indexPath()), 0755); err != nil {
+		return nil, false, err
+	}
+
+	rebuild := false
+	options := &bolt.Options{Timeout: time.Second}
+	db, err := bolt.Open(indexPath(), 0644, options)
+	if err == bolt.ErrTimeout {
+		return nil, false, fmt.Errorf("cache index %s is in use by another process", indexPath())
+	}
+	if err != nil {
+		log.Printf("Cache index %s is damaged, starting a new one: %s", indexPath(), err)
+		if err := os.Remove(indexPath()); err != nil {
+			return nil, false, err
+		}
+		if db, err = bolt.Open(indexPath(), 0644, options); err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		rebuild = state == nil || state.Get(cleanKey) == nil
+		for _, name := range [][]byte{entriesBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		for _, order := range orderBuckets {
+			if tx.Bucket(order.name) != nil {
+				continue
+			}
+			if err := fillOrderBucket(tx, order.name, order.value); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(stateBucket).Delete(cleanKey)
+	})
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	return db, rebuild, nil
+}
+
+// closeIndexLocked marks the index clean and closes it. Callers hold index.
+func closeIndexLocked() {
+	if index.db == nil {
+		return
+	}
+	err := index.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(cleanKey, []byte{1})
+	})
+	if err != nil {
+		log.Printf("Error marking cache index clean, it will be rebuilt on start: %s", err)
+	}
+	if err := index.db.Close(); err != nil {
+		log.Printf("Error closing cache index: %s", err)
+	}
+	index.db = nil
+}
+
+// closeIndex closes the index on shutdown. Anything still running that
+// uses it from then on gets errIndexClosed.
+func closeIndex() {
+	flushMetaHits()
+	index.Lock()
+	defer index.Unlock()
+	closeIndexLocked()
+}
+
+// indexDB returns the open index, or errIndexClosed when there is none
+func indexDB() (*bolt.DB, error) {
+	index.Lock()
+	defer index.Unlock()
+	if index.db == nil {
+		return nil, errIndexClosed
+	}
+	return index.db, nil
+}
+
+// fillOrderBucket creates an order bucket for the entries already indexed,
+// for indexes written before it was added
+func fillOrderBucket(tx *bolt.Tx, name []byte, value func(e *indexEntry) int64) error {
+	bucket, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).ForEach(func(key []byte, data []byte) error {
+		entry := indexEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil
+		}
+		return bucket.Put(orderKey(value(&entry), entry.Key), nil)
+	})
+}
+
+// orderKey is an entry's key in an order bucket. Values are never negative
+// so they sort as unsigned.
+func orderKey(value int64, key string) []byte {
+	if value < 0 {
+		value = 0
+	}
+	buf := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(buf, uint64(value))
+	return append(buf, key...)
+}
+
+// positionKey is the bucket key of a position in order, nil meaning by key
+func positionKey(order []byte, pos indexPosition) []byte {
+	if order == nil {
+		return []byte(pos.Key)
+	}
+	return orderKey(pos.Value, pos.Key)
+}
+
+// keyPosition is the position of a bucket key in order
+func keyPosition(order []byte, k []byte) indexPosition {
+	if order == nil {
+		return indexPosition{Key: string(k)}
+	}
+	return indexPosition{Value: int64(binary.BigEndian.Uint64(k[:8])), Key: string(k[8:])}
+}
+
+func addIndexTotal(tx *bolt.Tx, name []byte, delta int64) error {
+	state := tx.Bucket(stateBucket)
+	var value int64
+	if current := state.Get(name); len(current) == 8 {
+		value = int64(binary.BigEndian.Uint64(current))
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(value+delta))
+	return state.Put(name, buf)
+}
+
+func getIndexEntry(tx *bolt.Tx, key string) (*indexEntry, error) {
+	data := tx.Bucket(entriesBucket).Get([]byte(key))
+	if data == nil {
+		return nil, os.ErrNotExist
+	}
+	entry := &indexEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// putIndexEntry adds or replaces an entry, keeping the LRU order and
+// totals in step
+func putIndexEntry(tx *bolt.Tx, entry indexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	files, size := int64(1), entry.Size
+	if previous, err := getIndexEntry(tx, entry.Key); err == nil {
+		for _, order := range orderBuckets {
+			if err := tx.Bucket(order.name).Delete(orderKey(order.value(previous), previous.Key)); err != nil {
+				return err
+			}
+		}
+		files, size = 0, entry.Size-previous.Size
+	}
+
+	if err := tx.Bucket(entriesBucket).Put([]byte(entry.Key), data); err != nil {
+		return err
+	}
+	for _, order := range orderBuckets {
+		if err := tx.Bucket(order.name).Put(orderKey(order.value(&entry), entry.Key), nil); err != nil {
+			return err
+		}
+	}
+	if err := addIndexTotal(tx, filesKey, files); err != nil {
+		return err
+	}
+	return addIndexTotal(tx, sizeKey, size)
+}
+
+func deleteIndexEntry(tx *bolt.Tx, key string) error {
+	entry, err := getIndexEntry(tx, key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(entriesBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	for _, order := range orderBuckets {
+		if err := tx.Bucket(order.name).Delete(orderKey(order.value(entry), key)); err != nil {
+			return err
+		}
+	}
+	if err := addIndexTotal(tx, filesKey, -1); err != nil {
+		return err
+	}
+	return addIndexTotal(tx, sizeKey, -entry.Size)
+}
+
+// indexPut records a cache entry. replaced reports whether it took the
+// place of an entry already cached under the key, of previousSize bytes.
+func indexPut(entry indexEntry) (replaced bool, previousSize int64, err error) {
+	db, err := indexDB()
+	if err != nil {
+		return false, 0, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		previous, err := getIndexEntry(tx, entry.Key)
+		if err == nil {
+			replaced, previousSize = true, previous.Size
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return putIndexEntry(tx, entry)
+	})
+	return replaced, previousSize, err
+}
+
+// indexGet looks up a cache entry. Keys that aren't cached are reported as
+// os.ErrNotExist.
+func indexGet(key string) (*indexEntry, error) {
+	db, err := indexDB()
+	if err != nil {
+		return nil, err
+	}
+	var entry *indexEntry
+	err = db.View(func(tx *bolt.Tx) error {
+		entry, err = getIndexEntry(tx, key)
+		return err
+	})
+	if os.IsNotExist(err) && !isScanComplete() {
+		// Until the index is rebuilt it may not know files that are cached
+		info, statErr := os.Stat(filepath.Join(args.dataDir, key))
+		if statErr != nil || !info.Mode().IsRegular() {
+			return nil, err
+		}
+		disk := diskIndexEntry(key, info)
+		return &disk, nil
+	}
+	return entry, err
+}
+
+// indexDelete forgets a cache entry
+func indexDelete(key string) error {
+	db, err := indexDB()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteIndexEntry(tx, key)
+	})
+}
+
+// indexHits counts buffered hits and moves their entries to the back of the
+// LRU order, all in one transaction. Entries removed since are skipped.
+func indexHits(hits map[string]*metaHit) error {
+	db, err := indexDB()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for key, hit := range hits {
+			entry, err := getIndexEntry(tx, key)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			entry.Hits += hit.hits
+			entry.LastAccess = hit.lastAccess
+			if err := putIndexEntry(tx, *entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexEntries returns every cache entry
+func indexEntries() ([]indexEntry, error) {
+	db, err := indexDB()
+	if err != nil {
+		return nil, err
+	}
+	entries := []indexEntry{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(key []byte, data []byte) error {
+			entry := indexEntry{}
+			if err := json.Unmarshal(data, &entry); err != nil {
+				log.Printf("Skipping unreadable cache index entry %s: %s", key, err)
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// indexScan calls fn with entries in order, or by key if order is nil,
+// descending if desc is set, until it returns false. A scan resumes after
+// the position of an earlier one when after is set. Entries are read a
+// batch at a time, so changes made during a scan may or may not be seen.
+func indexScan(order []byte, desc bool, after *indexPosition, fn func(entry *indexEntry, pos indexPosition) bool) error {
+	db, err := indexDB()
+	if err != nil {
+		return err
+	}
+
+	type scanned struct {
+		entry *indexEntry
+		pos   indexPosition
+	}
+	for {
+		batch := make([]scanned, 0, indexScanBatch)
+		err := db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(entriesBucket)
+			if order != nil {
+				bucket = tx.Bucket(order)
+			}
+			cursor := bucket.Cursor()
+			next := cursor.Next
+			if desc {
+				next = cursor.Prev
+			}
+
+			var k []byte
+			switch {
+			case after == nil && desc:
+				k, _ = cursor.Last()
+			case after == nil:
+				k, _ = cursor.First()
+			default:
+				start := positionKey(order, *after)
+				k, _ = cursor.Seek(start)
+				if desc && k == nil {
+					k, _ = cursor.Last()
+				} else if desc || bytes.Equal(k, start) {
+					k, _ = next()
+				}
+			}
+
+			for ; k != nil && len(batch) < indexScanBatch; k, _ = next() {
+				pos := keyPosition(order, k)
+				entry, err := getIndexEntry(tx, pos.Key)
+				if err != nil {
+					continue
+				}
+				batch = append(batch, scanned{entry, pos})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range batch {
+			if !fn(item.entry, item.pos) {
+				return nil
+			}
+		}
+		if len(batch) < indexScanBatch {
+			return nil
+		}
+		after = &batch[len(batch)-1].pos
+	}
+}
+
+// indexLeastRecentlyUsed returns the least recently used entries, oldest
+// first, until together they are at least size bytes
+func indexLeastRecentlyUsed(size uint64) ([]indexEntry, error) {
+	db, err := indexDB()
+	if err != nil {
+		return nil, err
+	}
+	entries := []indexEntry{}
+	err = db.View(func(tx *bolt.Tx) error {
+		var total uint64
+		cursor := tx.Bucket(lruBucket).Cursor()
+		for k, _ := cursor.First(); k != nil && total < size; k, _ = cursor.Next() {
+			entry, err := getIndexEntry(tx, string(k[8:]))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, *entry)
+			total += uint64(entry.Size)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// indexTotals returns how many files the index holds and their size
+func indexTotals() (files int64, size int64, err error) {
+	db, err := indexDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		state := tx.Bucket(stateBucket)
+		if value := state.Get(filesKey); len(value) == 8 {
+			files = int64(binary.BigEndian.Uint64(value))
+		}
+		if value := state.Get(sizeKey); len(value) == 8 {
+			size = int64(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// diskIndexEntry builds the entry for a cache file from its metadata
+// sidecar, or from the file alone when there is none
+func diskIndexEntry(key string, info os.FileInfo) indexEntry {
+	entry := indexEntry{}
+	if meta, err := readMetaFile(key); err == nil {
+		entry.CacheMeta = *meta
+	} else {
+		entry.NoMeta = true
+		entry.Key = key
+		entry.StoredAt = info.ModTime().UTC()
+	}
+	entry.Size = info.Size()
+	return entry
+}
+
+// rebuildIndex brings the index in line with the data dir. Files the index
+// doesn't know, or knows with the wrong size, are indexed from their
+// metadata sidecars; entries whose files are gone are dropped. Hits and
+// last access of entries that were right are kept.
+func rebuildIndex(db *bolt.DB) (files int, size int64, err error) {
+	dirEntries, err := os.ReadDir(args.dataDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	onDisk := map[string]bool{}
+	for start := 0; start < len(dirEntries); start += indexRebuildBatch {
+		end := start + indexRebuildBatch
+		if end > len(dirEntries) {
+			end = len(dirEntries)
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			for _, file := range dirEntries[start:end] {
+				if !file.Type().IsRegular() {
+					continue
+				}
+				info, err := file.Info()
+				if err != nil {
+					continue
+				}
+				onDisk[file.Name()] = true
+				files++
+				size += info.Size()
+
+				if entry, err := getIndexEntry(tx, file.Name()); err == nil && entry.Size == info.Size() {
+					continue
+				}
+				if err := putIndexEntry(tx, diskIndexEntry(file.Name(), info)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Files cached while the data dir was being read are on disk too, so
+	// check before dropping anything
+	gone := []string{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(key []byte, data []byte) error {
+			if !onDisk[string(key)] {
+				if _, err := os.Stat(filepath.Join(args.dataDir, string(key))); os.IsNotExist(err) {
+					gone = append(gone, string(key))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, key := range gone {
+			if err := deleteIndexEntry(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// rebuildCacheIndex rebuilds the index of the data dir from the files in it
+func rebuildCacheIndex() (files int, size int64, err error) {
+	db, err := indexDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	return rebuildIndex(db)
+}
+
+// StartIndex opens the cache index. When it has to be rebuilt that happens
+// in the background; the cache totals are loaded once the index is ready.
+func StartIndex() error {
+	index.Lock()
+	closeIndexLocked()
+	db, rebuild, err := openIndex()
+	if err != nil {
+		index.Unlock()
+		return err
+	}
+	index.db = db
+	index.Unlock()
+
+	go func() {
+		if rebuild || args.rebuildIndex {
+			log.Printf("Rebuilding cache index from %s", args.dataDir)
+			start := time.Now()
+			files, size, err := rebuildIndex(db)
+			if err != nil {
+				log.Printf("Error rebuilding cache index, cache size metrics may be off: %s", err)
+				incErrors()
+			} else {
+				log.Printf("Indexed %d files (%d bytes) in %s", files, size, time.Since(start))
+			}
+		}
+
+		files, size, err := indexTotals()
+		if err != nil {
+			log.Printf("Error reading cache totals from the index: %s", err)
+			incErrors()
+		}
+		setCacheTotals(files, size)
+		atomic.StoreInt32(&scanComplete, 1)
+	}()
+	return nil
+}
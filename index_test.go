@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func waitForScan(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !isScanComplete() {
+		if time.Now().After(deadline) {
+			t.Fatal("cache index did not load")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// openTestIndex opens the index of the test's data dir, rebuilt from the
+// files already there, and closes it once the test is done
+func openTestIndex(t *testing.T) {
+	atomic.StoreInt32(&scanComplete, 0)
+	if err := StartIndex(); err != nil {
+		t.Fatal(err)
+	}
+	waitForScan(t)
+	t.Cleanup(closeIndex)
+}
+
+// crashIndex closes the index without marking it clean, like a crash
+func crashIndex(t *testing.T) {
+	index.Lock()
+	defer index.Unlock()
+	if err := index.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index.db = nil
+}
+
+// TestStartIndex builds the index of a data dir that has none and loads
+// the cache totals from it
+func TestStartIndex(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg")
+	closeIndex()
+	if err := os.Remove(indexPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&scanComplete, 0)
+	if err := StartIndex(); err != nil {
+		t.Fatal(err)
+	}
+	waitForScan(t)
+	if getFilesCount() != 3 || getSizeCount() != 26 {
+		t.Errorf("expected 3 files of 26 bytes, got %d files of %d bytes", getFilesCount(), getSizeCount())
+	}
+	if files, size, err := indexTotals(); err != nil || files != 3 || size != 26 {
+		t.Errorf("expected index totals of 3 files and 26 bytes, got %d, %d, %v", files, size, err)
+	}
+
+	// A clean shutdown is trusted, nothing is rebuilt
+	closeIndex()
+	index.Lock()
+	_, rebuild, err := openIndex()
+	index.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuild {
+		t.Error("expected a cleanly closed index not to need a rebuild")
+	}
+	closeIndex()
+}
+
+// TestIndexRecovery changes the data dir while tenta is down uncleanly and
+// checks the index catches up, keeping what it knew about unchanged entries
+func TestIndexRecovery(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg")
+	r, err := newKeyRequest("http://dl.example.com/a.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := generateCacheFilename(generateURL(r), r)
+	recordMetaHit(kept)
+	flushMetaHits()
+
+	crashIndex(t)
+	if err := os.Remove(filepath.Join(args.dataDir, "12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(args.dataDir, "67890"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	openTestIndex(t)
+
+	entries, err := indexEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]indexEntry{}
+	for _, entry := range entries {
+		found[entry.Key] = entry
+	}
+	if _, ok := found["12345"]; ok {
+		t.Error("expected the removed file to be dropped from the index")
+	}
+	if entry, ok := found["67890"]; !ok || !entry.NoMeta || entry.Size != 3 {
+		t.Errorf("expected the new file indexed without metadata, got %+v", entry)
+	}
+	if entry := found[kept]; entry.Hits != 1 || entry.URL != "http://dl.example.com/a.pkg" {
+		t.Errorf("expected the unchanged entry to keep its hit and URL, got %+v", entry)
+	}
+	if files, size, _ := indexTotals(); files != 3 || size != 23 {
+		t.Errorf("expected index totals of 3 files and 23 bytes, got %d and %d", files, size)
+	}
+}
+
+// TestIndexDamaged replaces an index that can't be opened with one rebuilt
+// from the metadata sidecars
+func TestIndexDamaged(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+	closeIndex()
+	if err := os.WriteFile(indexPath(), []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&scanComplete, 0)
+	if err := StartIndex(); err != nil {
+		t.Fatal(err)
+	}
+	waitForScan(t)
+
+	r, err := newKeyRequest("http://dl.example.com/a.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := readMeta(generateCacheFilename(generateURL(r), r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.URL != "http://dl.example.com/a.pkg" {
+		t.Errorf("expected the URL from the sidecar, got %q", meta.URL)
+	}
+	if _, err := readMeta("12345"); !os.IsNotExist(err) {
+		t.Errorf("expected no metadata for the legacy entry, got %v", err)
+	}
+}
+
+func TestIndexLeastRecentlyUsed(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg")
+	entries, err := indexEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use everything but the first entry in the LRU order
+	oldest, err := indexLeastRecentlyUsed(1)
+	if err != nil || len(oldest) != 1 {
+		t.Fatalf("expected one entry, got %v, %v", oldest, err)
+	}
+	for _, entry := range entries {
+		if entry.Key != oldest[0].Key {
+			recordMetaHit(entry.Key)
+		}
+	}
+	recordMetaHit(oldest[0].Key)
+	flushMetaHits()
+
+	lru, err := indexLeastRecentlyUsed(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lru) != 2 || lru[0].Key == oldest[0].Key || lru[1].Key == oldest[0].Key {
+		t.Errorf("expected the two entries used before %s, got %+v", oldest[0].Key, lru)
+	}
+}
+
+// TestIndexScan checks ordered scans across batches, in both directions
+// and resumed from a position
+func TestIndexScan(t *testing.T) {
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	openTestIndex(t)
+	db, err := indexDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := indexScanBatch*2 + 500
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < count; i++ {
+			entry := indexEntry{NoMeta: true}
+			entry.Key = fmt.Sprintf("%05d", i)
+			entry.Size = int64(count - i)
+			if err := putIndexEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(order []byte, desc bool, after *indexPosition) []string {
+		keys := []string{}
+		err := indexScan(order, desc, after, func(entry *indexEntry, pos indexPosition) bool {
+			keys = append(keys, entry.Key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	byKey := scan(nil, false, nil)
+	if len(byKey) != count || byKey[0] != "00000" || byKey[count-1] != fmt.Sprintf("%05d", count-1) {
+		t.Errorf("expected %d keys in order, got %d from %s", count, len(byKey), byKey[0])
+	}
+	// Sizes count down as keys count up
+	bySize := scan(bySizeBucket, true, nil)
+	if len(bySize) != count || bySize[0] != "00000" || bySize[1] != "00001" {
+		t.Errorf("expected the biggest entries first, got %d starting %v", len(bySize), bySize[:2])
+	}
+
+	after := &indexPosition{Key: "01234"}
+	if keys := scan(nil, false, after); len(keys) != count-1235 || keys[0] != "01235" {
+		t.Errorf("expected to resume after 01234, got %d starting %s", len(keys), keys[0])
+	}
+	if keys := scan(nil, true, after); len(keys) != 1234 || keys[0] != "01233" {
+		t.Errorf("expected to resume before 01234, got %d starting %s", len(keys), keys[0])
+	}
+	after = &indexPosition{Value: int64(count - 1234), Key: "01234"}
+	if keys := scan(bySizeBucket, true, after); len(keys) != count-1235 || keys[0] != "01235" {
+		t.Errorf("expected to resume after 01234 by size, got %d starting %s", len(keys), keys[0])
+	}
+}
+
+// TestIndexOrderBucketsFilled checks that an index written before an order
+// was added gets it filled in from its entries
+func TestIndexOrderBucketsFilled(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg")
+	db, err := indexDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(byHitsBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index.Lock()
+	closeIndexLocked()
+	db, _, err = openIndex()
+	index.db = db
+	index.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := 0
+	err = indexScan(byHitsBucket, false, nil, func(entry *indexEntry, pos indexPosition) bool {
+		scanned++
+		return true
+	})
+	if err != nil || scanned != 3 {
+		t.Errorf("expected 3 entries ordered by hits, got %d: %v", scanned, err)
+	}
+}
+
+// TestIndexClosed checks that the index isn't brought back by anything
+// still running after shutdown closed it
+func TestIndexClosed(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+	closeIndex()
+
+	if _, err := indexGet("12345"); err != errIndexClosed {
+		t.Errorf("expected errIndexClosed from a lookup, got %v", err)
+	}
+	if err := writeMeta(newCacheMeta("67890", "http://dl.example.com/b.pkg", "", 3, nil)); err != errIndexClosed {
+		t.Errorf("expected errIndexClosed from a write, got %v", err)
+	}
+
+	atomic.StoreInt32(&scanComplete, 0)
+	if err := StartIndex(); err != nil {
+		t.Fatal(err)
+	}
+	waitForScan(t)
+	if _, err := indexGet("12345"); err != nil {
+		t.Errorf("expected the index to be usable once started again, got %v", err)
+	}
+}
+
+// TestIndexGetWhileLoading checks that files the index doesn't know yet are
+// found on disk until it has been rebuilt
+func TestIndexGetWhileLoading(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+	r, err := newKeyRequest("http://dl.example.com/a.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := generateCacheFilename(generateURL(r), r)
+	crashIndex(t)
+	if err := os.Remove(indexPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new index, as if StartIndex were still rebuilding it
+	index.Lock()
+	db, _, err := openIndex()
+	index.db = db
+	index.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer atomic.StoreInt32(&scanComplete, atomic.LoadInt32(&scanComplete))
+	atomic.StoreInt32(&scanComplete, 0)
+
+	entry, err := indexGet(key)
+	if err != nil || entry.URL != "http://dl.example.com/a.pkg" || entry.Size != 10 {
+		t.Errorf("expected the entry from disk, got %+v: %v", entry, err)
+	}
+	if _, err := indexGet("67890"); !os.IsNotExist(err) {
+		t.Errorf("expected files that aren't on disk to be missing, got %v", err)
+	}
+
+	atomic.StoreInt32(&scanComplete, 1)
+	if _, err := indexGet(key); !os.IsNotExist(err) {
+		t.Errorf("expected the loaded index to be trusted, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// largeFill is the smallest fill whose throughput is recorded. Below it
+// connection setup dominates and the numbers say little about bandwidth.
+const largeFill = 10 * 1024 * 1024
+
+var (
+	tentaRequestDuration *prometheus.HistogramVec
+	tentaUpstreamPhase   *prometheus.HistogramVec
+	tentaDiskDuration    *prometheus.HistogramVec
+	tentaFillThroughput  prometheus.Histogram
+)
+
+func init() {
+	tentaRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tenta_request_duration_seconds",
+		Help:    "Time to serve proxied requests, including the whole body, by cache status",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"cache_status"})
+	tentaUpstreamPhase = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tenta_upstream_phase_duration_seconds",
+		Help:    "Time spent in each phase of upstream requests: dns, connect, tls and ttfb (request start to first response byte)",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"phase"})
+	tentaDiskDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tenta_disk_duration_seconds",
+		Help:    "Time taken by individual cache file reads and writes",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"op"})
+	tentaFillThroughput = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tenta_fill_throughput_bytes_per_second",
+		Help:    "Download speed of cache fills of 10 MiB or more",
+		Buckets: prometheus.ExponentialBuckets(64*1024, 2, 14),
+	})
+}
+
+func observeRequestDuration(cacheStatus string, d time.Duration) {
+	if cacheStatus != "" {
+		tentaRequestDuration.WithLabelValues(strings.ToLower(cacheStatus)).Observe(d.Seconds())
+	}
+}
+
+func observeFillThroughput(size int64, d time.Duration) {
+	if size >= largeFill && d > 0 {
+		tentaFillThroughput.Observe(float64(size) / d.Seconds())
+	}
+}
+
+// upstreamTrace times the phases of one upstream request. Hooks can run
+// concurrently when several addresses are dialed at once.
+type upstreamTrace struct {
+	sync.Mutex
+	start    time.Time
+	dns      time.Time
+	connects map[string]time.Time
+	tls      time.Time
+}
+
+func newUpstreamTrace() *upstreamTrace {
+	return &upstreamTrace{start: time.Now(), connects: map[string]time.Time{}}
+}
+
+func (u *upstreamTrace) since(phase string, start time.Time) {
+	if !start.IsZero() {
+		tentaUpstreamPhase.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+	}
+}
+
+// clientTrace returns the httptrace hooks, calling gotConn for every
+// connection handed to the request
+func (u *upstreamTrace) clientTrace(gotConn func(httptrace.GotConnInfo)) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			u.Lock()
+			u.dns = time.Now()
+			u.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			u.Lock()
+			defer u.Unlock()
+			if info.Err == nil {
+				u.since("dns", u.dns)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			u.Lock()
+			u.connects[addr] = time.Now()
+			u.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			u.Lock()
+			defer u.Unlock()
+			if err == nil {
+				u.since("connect", u.connects[addr])
+			}
+		},
+		TLSHandshakeStart: func() {
+			u.Lock()
+			u.tls = time.Now()
+			u.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			u.Lock()
+			defer u.Unlock()
+			if err == nil {
+				u.since("tls", u.tls)
+			}
+		},
+		GotConn: gotConn,
+		GotFirstResponseByte: func() {
+			u.since("ttfb", u.start)
+		},
+	}
+}
+
+// diskReader times reads of a cache file being served
+type diskReader struct {
+	io.Reader
+}
+
+func (d diskReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := d.Reader.Read(p)
+	tentaDiskDuration.WithLabelValues("read").Observe(time.Since(start).Seconds())
+	return n, err
+}
+
+// diskWriter times writes to a cache file being filled
+type diskWriter struct {
+	io.Writer
+}
+
+func (d diskWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := d.Writer.Write(p)
+	tentaDiskDuration.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	return n, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestUpstreamPhaseTimings(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	before := map[string]uint64{}
+	for _, phase := range []string{"connect", "tls", "ttfb"} {
+		before[phase] = sampleCount(t, tentaUpstreamPhase.WithLabelValues(phase))
+	}
+
+	transport := origin.Client().Transport.(*http.Transport).Clone()
+	client := &http.Client{Transport: &instrumentedTransport{base: transport}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// The second request reuses the connection, so only ttfb is timed twice
+	expected := map[string]uint64{"connect": 1, "tls": 1, "ttfb": 2}
+	for phase, count := range expected {
+		if got := sampleCount(t, tentaUpstreamPhase.WithLabelValues(phase)) - before[phase]; got != count {
+			t.Errorf("%s: expected %d observations, got %d", phase, count, got)
+		}
+	}
+}
+
+func TestDiskAndFillTimings(t *testing.T) {
+	reads := sampleCount(t, tentaDiskDuration.WithLabelValues("read"))
+	writes := sampleCount(t, tentaDiskDuration.WithLabelValues("write"))
+	fills := sampleCount(t, tentaFillThroughput)
+
+	io.Copy(diskWriter{io.Discard}, diskReader{bytes.NewReader([]byte("0123456789"))})
+	if got := sampleCount(t, tentaDiskDuration.WithLabelValues("read")) - reads; got < 1 {
+		t.Errorf("expected reads to be timed, got %d", got)
+	}
+	if got := sampleCount(t, tentaDiskDuration.WithLabelValues("write")) - writes; got != 1 {
+		t.Errorf("expected 1 write to be timed, got %d", got)
+	}
+
+	observeFillThroughput(largeFill-1, time.Second)
+	observeFillThroughput(largeFill, time.Second)
+	if got := sampleCount(t, tentaFillThroughput) - fills; got != 1 {
+		t.Errorf("expected only the large fill to be recorded, got %d", got)
+	}
+}
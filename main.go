@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -18,13 +21,84 @@ var Cmd = &cobra.Command{
 }
 
 var args struct {
-	debug           bool
-	dataDir         string
-	maxCacheAge     int
-	cronSchedule    string
-	httpPort        int
-	requestTimeout  int
-	maxBodySize     int64
+	configFile     string
+	debug          bool
+	dataDir        string
+	maxCacheAge    int
+	cronSchedule   string
+	httpPort       int
+	requestTimeout int
+	maxBodySize    int64
+	parents        []string
+	siblings       []string
+	siblingTimeout int
+	instanceID     string
+	maxHops        int
+
+	dnsResolvers                []string
+	upstreamProxy               string
+	upstreamMaxIdleConns        int
+	upstreamMaxIdleConnsPerHost int
+	upstreamMaxConnsPerHost     int
+	upstreamIdleConnTimeout     int
+	upstreamKeepAlive           int
+	upstreamTLSHandshakeTimeout int
+	upstreamHTTP2               bool
+	upstreamDialTimeout         int
+	upstreamTTFBTimeout         int
+	upstreamIdleTimeout         int
+	upstreamRetries             int
+	upstreamRetryBackoff        int
+	upstreamRetryMaxBackoff     int
+
+	limitOrigin      int64
+	limitOriginHost  int64
+	limitOriginHosts map[string]int64
+	limitClient      int64
+	limitHitPriority bool
+
+	trustedProxies []string
+	proxyProtocol  bool
+
+	serverReadHeaderTimeout int
+	serverIdleTimeout       int
+	serverWriteIdleTimeout  int
+
+	prefetchWorkers int
+
+	rebuildIndex bool
+
+	readyMinFree      string
+	diskHighWatermark string
+	diskLowWatermark  string
+
+	adminAddr         string
+	adminTokens       []string
+	adminReadTokens   []string
+	adminTLSCert      string
+	adminTLSKey       string
+	adminClientCA     string
+	adminClientAdmins []string
+
+	accessLog           string
+	accessLogFormat     string
+	accessLogMaxSize    int64
+	accessLogMaxAge     int
+	accessLogMaxBackups int
+	accessLogSample     float64
+
+	metricsEnabled  bool
+	metricsAddr     string
+	metricsPath     string
+	metricsOnAdmin  bool
+	metricsHosts    []string
+	metricsMaxHosts int
+
+	otelEndpoint    string
+	otelProtocol    string
+	otelInsecure    bool
+	otelServiceName string
+	otelSampleRatio float64
 }
 
 func init() {
@@ -49,6 +123,13 @@ func init() {
 		"Port to use for the HTTP server",
 	)
 
+	flags.StringVar(
+		&args.configFile,
+		"config",
+		"",
+		"YAML or TOML config file (.yaml, .yml or .toml). Also read from TENTA_CONFIG",
+	)
+
 	flags.BoolVar(
 		&args.debug,
 		"debug",
@@ -66,8 +147,8 @@ func init() {
 	flags.IntVar(
 		&args.requestTimeout,
 		"request-timeout",
-		30,
-		"Timeout (in seconds) for outbound HTTP requests",
+		0,
+		"Total timeout (in seconds) for outbound HTTP requests, including the body. Value of 0 means no limit (default 0)",
 	)
 
 	flags.Int64Var(
@@ -77,6 +158,419 @@ func init() {
 		"Maximum size (in bytes) of response bodies to cache",
 	)
 
+	flags.StringSliceVar(
+		&args.parents,
+		"parent",
+		nil,
+		"Parent tenta URL to fetch cache misses through instead of the origin (repeatable, tried in order)",
+	)
+
+	flags.StringSliceVar(
+		&args.siblings,
+		"sibling",
+		nil,
+		"Sibling tenta URL to ask for a cached copy before going upstream (repeatable)",
+	)
+
+	flags.IntVar(
+		&args.siblingTimeout,
+		"sibling-timeout",
+		500,
+		"Timeout (in milliseconds) for sibling cache lookups",
+	)
+
+	flags.StringVar(
+		&args.instanceID,
+		"instance-id",
+		"",
+		"Identifier recorded in the tenta-proxy header for loop detection (default hostname:http-port)",
+	)
+
+	flags.IntVar(
+		&args.maxHops,
+		"max-hops",
+		4,
+		"Maximum number of tenta instances a request may pass through before it is treated as a loop",
+	)
+
+	flags.StringSliceVar(
+		&args.dnsResolvers,
+		"dns-resolver",
+		[]string{"8.8.8.8:53"},
+		"DNS servers (host:port) used to resolve upstream hosts, bypassing any LAN DNS pointing at tenta (repeatable, used in turn)",
+	)
+
+	flags.StringVar(
+		&args.upstreamProxy,
+		"upstream-proxy",
+		"env",
+		"Proxy for upstream requests: a URL, \"env\" to use HTTP_PROXY/HTTPS_PROXY, or empty for none",
+	)
+
+	flags.IntVar(
+		&args.upstreamMaxIdleConns,
+		"upstream-max-idle-conns",
+		100,
+		"Maximum idle upstream connections across all hosts (0 means no limit)",
+	)
+
+	flags.IntVar(
+		&args.upstreamMaxIdleConnsPerHost,
+		"upstream-max-idle-conns-per-host",
+		16,
+		"Maximum idle upstream connections kept per host",
+	)
+
+	flags.IntVar(
+		&args.upstreamMaxConnsPerHost,
+		"upstream-max-conns-per-host",
+		0,
+		"Maximum upstream connections per host, including active ones (0 means no limit)",
+	)
+
+	flags.IntVar(
+		&args.upstreamIdleConnTimeout,
+		"upstream-idle-conn-timeout",
+		90,
+		"Time (in seconds) an idle upstream connection is kept in the pool",
+	)
+
+	flags.IntVar(
+		&args.upstreamKeepAlive,
+		"upstream-keepalive",
+		30,
+		"TCP keep-alive period (in seconds) for upstream connections. Value of 0 disables keep-alives and connection reuse",
+	)
+
+	flags.IntVar(
+		&args.upstreamTLSHandshakeTimeout,
+		"upstream-tls-handshake-timeout",
+		10,
+		"Timeout (in seconds) for upstream TLS handshakes",
+	)
+
+	flags.BoolVar(
+		&args.upstreamHTTP2,
+		"upstream-http2",
+		true,
+		"Attempt HTTP/2 when talking to HTTPS origins",
+	)
+
+	flags.IntVar(
+		&args.upstreamDialTimeout,
+		"upstream-dial-timeout",
+		10,
+		"Timeout (in seconds) for establishing upstream TCP connections",
+	)
+
+	flags.IntVar(
+		&args.upstreamTTFBTimeout,
+		"upstream-ttfb-timeout",
+		30,
+		"Timeout (in seconds) waiting for upstream response headers once the request is sent. Value of 0 means no limit",
+	)
+
+	flags.IntVar(
+		&args.upstreamIdleTimeout,
+		"upstream-idle-timeout",
+		60,
+		"Abort an upstream download when no data arrives for this many seconds. Value of 0 means no limit",
+	)
+
+	flags.IntVar(
+		&args.upstreamRetries,
+		"upstream-retries",
+		3,
+		"Number of times a failed or interrupted upstream download is retried",
+	)
+
+	flags.IntVar(
+		&args.upstreamRetryBackoff,
+		"upstream-retry-backoff",
+		500,
+		"Delay (in milliseconds) before the first upstream retry, doubled on each further attempt",
+	)
+
+	flags.IntVar(
+		&args.upstreamRetryMaxBackoff,
+		"upstream-retry-max-backoff",
+		30000,
+		"Maximum delay (in milliseconds) between upstream retries",
+	)
+
+	flags.Int64Var(
+		&args.limitOrigin,
+		"limit-origin",
+		0,
+		"Total bandwidth (in bytes/s) for fetching from origins and parents. Value of 0 means unlimited",
+	)
+
+	flags.Int64Var(
+		&args.limitOriginHost,
+		"limit-origin-host",
+		0,
+		"Bandwidth (in bytes/s) for fetching from any single origin host. Value of 0 means unlimited",
+	)
+
+	flags.StringToInt64Var(
+		&args.limitOriginHosts,
+		"limit-origin-hosts",
+		nil,
+		"Per-host bandwidth overrides (in bytes/s), e.g. dl.example.com=1048576",
+	)
+
+	flags.Int64Var(
+		&args.limitClient,
+		"limit-client",
+		0,
+		"Bandwidth (in bytes/s) for serving any single client IP. Value of 0 means unlimited",
+	)
+
+	flags.BoolVar(
+		&args.limitHitPriority,
+		"limit-hit-priority",
+		false,
+		"Serve cache hits ahead of misses and pass-through traffic when a client is at its limit",
+	)
+
+	flags.StringSliceVar(
+		&args.trustedProxies,
+		"trusted-proxies",
+		nil,
+		"IPs or CIDRs of load balancers allowed to set X-Forwarded-For/Forwarded and PROXY protocol headers",
+	)
+
+	flags.BoolVar(
+		&args.proxyProtocol,
+		"proxy-protocol",
+		false,
+		"Accept PROXY protocol v1/v2 headers on the HTTP listener from --trusted-proxies, which must be set",
+	)
+
+	flags.IntVar(
+		&args.serverReadHeaderTimeout,
+		"server-read-header-timeout",
+		10,
+		"Timeout (in seconds) for reading client request headers",
+	)
+
+	flags.IntVar(
+		&args.serverIdleTimeout,
+		"server-idle-timeout",
+		120,
+		"Time (in seconds) an idle keep-alive client connection is kept open",
+	)
+
+	flags.IntVar(
+		&args.serverWriteIdleTimeout,
+		"server-write-idle-timeout",
+		60,
+		"Disconnect a client that accepts no data for this many seconds. Value of 0 means no limit",
+	)
+
+	flags.IntVar(
+		&args.prefetchWorkers,
+		"prefetch-workers",
+		4,
+		"Number of URLs prefetch jobs download at once, shared by all jobs",
+	)
+
+	flags.BoolVar(
+		&args.rebuildIndex,
+		"rebuild-index",
+		false,
+		"Rebuild the cache index from the data dir on start",
+	)
+
+	flags.StringVar(
+		&args.readyMinFree,
+		"ready-min-free",
+		"1%",
+		"Free space in the data dir below which /api/readyz fails, in bytes (K, M, G, T suffixes) or percent",
+	)
+
+	flags.StringVar(
+		&args.diskHighWatermark,
+		"disk-high-watermark",
+		"0",
+		"Free (not used) space in the data dir below which least recently used files are evicted, in bytes (K, M, G, T suffixes) or percent. Must be lower than --disk-low-watermark. Value of 0 turns eviction off",
+	)
+
+	flags.StringVar(
+		&args.diskLowWatermark,
+		"disk-low-watermark",
+		"10%",
+		"Free (not used) space in the data dir that eviction works back up to, in bytes (K, M, G, T suffixes) or percent. Must be higher than --disk-high-watermark",
+	)
+
+	flags.StringVar(
+		&args.adminAddr,
+		"admin-addr",
+		"",
+		"Serve the admin API on its own address (e.g. 127.0.0.1:9090) instead of the proxy port",
+	)
+
+	flags.StringSliceVar(
+		&args.adminTokens,
+		"admin-token",
+		nil,
+		"Bearer token ([name:]token) with the admin role on the admin API (repeatable)",
+	)
+
+	flags.StringSliceVar(
+		&args.adminReadTokens,
+		"admin-read-token",
+		nil,
+		"Bearer token ([name:]token) with the read-only role on the admin API (repeatable)",
+	)
+
+	flags.StringVar(
+		&args.adminTLSCert,
+		"admin-tls-cert",
+		"",
+		"TLS certificate for the admin listener (requires --admin-addr)",
+	)
+
+	flags.StringVar(
+		&args.adminTLSKey,
+		"admin-tls-key",
+		"",
+		"TLS private key for the admin listener",
+	)
+
+	flags.StringVar(
+		&args.adminClientCA,
+		"admin-client-ca",
+		"",
+		"CA bundle for verifying admin client certificates (mTLS)",
+	)
+
+	flags.StringSliceVar(
+		&args.adminClientAdmins,
+		"admin-client-admins",
+		nil,
+		"Client certificate common names granted the admin role; other verified certificates are read-only",
+	)
+
+	flags.StringVar(
+		&args.accessLog,
+		"access-log",
+		"",
+		"Write an access log line per request to this file, or - for stdout. Empty disables it",
+	)
+
+	flags.StringVar(
+		&args.accessLogFormat,
+		"access-log-format",
+		"json",
+		"Access log format: json, common, combined or logfmt",
+	)
+
+	flags.Int64Var(
+		&args.accessLogMaxSize,
+		"access-log-max-size",
+		100,
+		"Rotate the access log file when it reaches this many megabytes. Value of 0 disables size rotation",
+	)
+
+	flags.IntVar(
+		&args.accessLogMaxAge,
+		"access-log-max-age",
+		0,
+		"Rotate the access log file after this many hours. Value of 0 disables time rotation",
+	)
+
+	flags.IntVar(
+		&args.accessLogMaxBackups,
+		"access-log-max-backups",
+		7,
+		"Number of rotated access log files to keep. Value of 0 keeps all",
+	)
+
+	flags.Float64Var(
+		&args.accessLogSample,
+		"access-log-sample",
+		1,
+		"Fraction of requests to log, between 0 and 1. Server errors are always logged",
+	)
+
+	flags.BoolVar(
+		&args.metricsEnabled,
+		"metrics-enabled",
+		true,
+		"Serve Prometheus metrics",
+	)
+
+	flags.StringVar(
+		&args.metricsAddr,
+		"metrics-addr",
+		":2112",
+		"Address for the Prometheus metrics listener",
+	)
+
+	flags.StringVar(
+		&args.metricsPath,
+		"metrics-path",
+		"/metrics",
+		"Path Prometheus metrics are served on",
+	)
+
+	flags.BoolVar(
+		&args.metricsOnAdmin,
+		"metrics-on-admin",
+		false,
+		"Serve metrics on the admin listener instead of metrics-addr, behind admin authentication. Requires admin-addr",
+	)
+
+	flags.StringSliceVar(
+		&args.metricsHosts,
+		"metrics-hosts",
+		[]string{},
+		"Origin hosts that always get their own label in per-host metrics (repeatable)",
+	)
+
+	flags.IntVar(
+		&args.metricsMaxHosts,
+		"metrics-max-hosts",
+		20,
+		"Number of further origin hosts that get their own label in per-host metrics once they reach 10 requests. The rest are counted as \"other\"",
+	)
+
+	flags.StringVar(
+		&args.otelEndpoint,
+		"otel-endpoint",
+		"",
+		"OTLP collector (host:port) to export OpenTelemetry traces to. Tracing is off when empty",
+	)
+
+	flags.StringVar(
+		&args.otelProtocol,
+		"otel-protocol",
+		"grpc",
+		"OTLP protocol: grpc (usually port 4317) or http (usually port 4318)",
+	)
+
+	flags.BoolVar(
+		&args.otelInsecure,
+		"otel-insecure",
+		false,
+		"Connect to the OTLP collector without TLS",
+	)
+
+	flags.StringVar(
+		&args.otelServiceName,
+		"otel-service-name",
+		"tenta",
+		"Service name reported with traces",
+	)
+
+	flags.Float64Var(
+		&args.otelSampleRatio,
+		"otel-sample-ratio",
+		1,
+		"Fraction of new traces to sample, between 0 and 1. Traces started by clients follow their sampling decision",
+	)
+
 	Cmd.RegisterFlagCompletionFunc("output-format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"json", "prom"}, cobra.ShellCompDirectiveDefault
 	})
@@ -122,8 +616,69 @@ func validateConfig() error {
 	}
 
 	// Validate request timeout
-	if args.requestTimeout < 1 {
-		return fmt.Errorf("request-timeout must be >= 1, got %d", args.requestTimeout)
+	if args.requestTimeout < 0 {
+		return fmt.Errorf("request-timeout must be >= 0, got %d", args.requestTimeout)
+	}
+	if args.upstreamDialTimeout < 1 {
+		return fmt.Errorf("upstream-dial-timeout must be >= 1, got %d", args.upstreamDialTimeout)
+	}
+	if args.upstreamTTFBTimeout < 0 || args.upstreamIdleTimeout < 0 {
+		return fmt.Errorf("upstream-ttfb-timeout and upstream-idle-timeout must be >= 0")
+	}
+	if args.upstreamRetries < 0 {
+		return fmt.Errorf("upstream-retries must be >= 0, got %d", args.upstreamRetries)
+	}
+	if args.upstreamRetryBackoff < 1 || args.upstreamRetryMaxBackoff < args.upstreamRetryBackoff {
+		return fmt.Errorf("upstream-retry-backoff must be >= 1 and <= upstream-retry-max-backoff")
+	}
+	networks, err := parseTrustedProxies(args.trustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+	if args.proxyProtocol && len(trustedProxies) == 0 {
+		// Otherwise any peer could claim to be any client
+		return fmt.Errorf("proxy-protocol requires trusted-proxies")
+	}
+
+	if err := validateBandwidth(argsBandwidth()); err != nil {
+		return err
+	}
+	if args.serverReadHeaderTimeout < 1 {
+		return fmt.Errorf("server-read-header-timeout must be >= 1, got %d", args.serverReadHeaderTimeout)
+	}
+	if args.serverIdleTimeout < 0 || args.serverWriteIdleTimeout < 0 {
+		return fmt.Errorf("server-idle-timeout and server-write-idle-timeout must be >= 0")
+	}
+	if args.prefetchWorkers < 1 {
+		return fmt.Errorf("prefetch-workers must be >= 1, got %d", args.prefetchWorkers)
+	}
+	if readyMinFree, err = parseSpaceThreshold(args.readyMinFree); err != nil {
+		return fmt.Errorf("ready-min-free: %w", err)
+	}
+	if err := validateWatermarks(); err != nil {
+		return err
+	}
+	if err := validateAdmin(); err != nil {
+		return err
+	}
+	if !isAccessLogFormat(args.accessLogFormat) {
+		return fmt.Errorf("access-log-format must be one of %s, got %q", strings.Join(accessLogFormats, ", "), args.accessLogFormat)
+	}
+	if args.accessLogMaxSize < 0 || args.accessLogMaxAge < 0 || args.accessLogMaxBackups < 0 {
+		return fmt.Errorf("access-log-max-size, access-log-max-age and access-log-max-backups must be >= 0")
+	}
+	if args.accessLogSample < 0 || args.accessLogSample > 1 {
+		return fmt.Errorf("access-log-sample must be between 0 and 1, got %g", args.accessLogSample)
+	}
+	if err := validateMetrics(); err != nil {
+		return err
+	}
+	if err := validateTracing(); err != nil {
+		return err
+	}
+	if args.metricsMaxHosts < 0 {
+		return fmt.Errorf("metrics-max-hosts must be >= 0, got %d", args.metricsMaxHosts)
 	}
 
 	// Validate max body size
@@ -131,15 +686,73 @@ func validateConfig() error {
 		return fmt.Errorf("max-body-size must be at least 1024 bytes, got %d", args.maxBodySize)
 	}
 
+	// Validate peers
+	for _, peer := range append(append([]string{}, args.parents...), args.siblings...) {
+		u, err := url.Parse(peer)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("peer must be an http(s) URL, got %q", peer)
+		}
+	}
+	if args.siblingTimeout < 1 {
+		return fmt.Errorf("sibling-timeout must be >= 1, got %d", args.siblingTimeout)
+	}
+	if args.maxHops < 1 {
+		return fmt.Errorf("max-hops must be >= 1, got %d", args.maxHops)
+	}
+	if args.instanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "tenta"
+		}
+		args.instanceID = fmt.Sprintf("%s:%d", hostname, args.httpPort)
+	}
+	if strings.Contains(args.instanceID, ",") {
+		return fmt.Errorf("instance-id must not contain commas, got %q", args.instanceID)
+	}
+
+	// Validate upstream transport
+	if len(args.dnsResolvers) == 0 {
+		return fmt.Errorf("dns-resolver must not be empty")
+	}
+	for _, resolver := range args.dnsResolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("dns-resolver must be host:port, got %q", resolver)
+		}
+	}
+	if _, err := upstreamProxy(); err != nil {
+		return err
+	}
+	if args.upstreamMaxIdleConns < 0 || args.upstreamMaxIdleConnsPerHost < 0 || args.upstreamMaxConnsPerHost < 0 {
+		return fmt.Errorf("upstream connection limits must be >= 0")
+	}
+	if args.upstreamIdleConnTimeout < 0 || args.upstreamKeepAlive < 0 || args.upstreamTLSHandshakeTimeout < 0 {
+		return fmt.Errorf("upstream timeouts must be >= 0")
+	}
+
 	// Note: Cron schedule validation happens in StartCron()
 	// We don't validate it here to avoid delaying startup
 
 	return nil
 }
 
+// argsBandwidth returns the bandwidth limits set on the command line
+func argsBandwidth() BandwidthLimits {
+	return BandwidthLimits{
+		Origin:      args.limitOrigin,
+		OriginHost:  args.limitOriginHost,
+		OriginHosts: args.limitOriginHosts,
+		Client:      args.limitClient,
+		HitPriority: args.limitHitPriority,
+	}
+}
+
 func run(cmd *cobra.Command, argv []string) error {
 	log.Println("Starting Tenta!")
 
+	if err := loadConfig(cmd.Flags()); err != nil {
+		return fmt.Errorf("configuration failed: %w", err)
+	}
+
 	// Validate configuration before starting
 	if err := validateConfig(); err != nil {
 		return fmt.Errorf("configuration validation failed: %w", err)
@@ -147,17 +760,62 @@ func run(cmd *cobra.Command, argv []string) error {
 
 	log.Printf("Configuration: dataDir=%s, maxCacheAge=%dh, httpPort=%d, cron=%s",
 		args.dataDir, args.maxCacheAge, args.httpPort, args.cronSchedule)
+	if len(args.parents) > 0 || len(args.siblings) > 0 {
+		log.Printf("Peering: instance=%s, parents=%v, siblings=%v",
+			args.instanceID, args.parents, args.siblings)
+	}
 
-	if args.debug {
+	if debugEnabled() {
 		go func() {
 			log.Println("Starting pprof server on port 6060")
 			log.Println(http.ListenAndServe(":6060", nil))
 		}()
 	}
 
+	if err := cleanPartialFiles(); err != nil {
+		return fmt.Errorf("failed to prepare data directory: %w", err)
+	}
+
+	if err := StartIndex(); err != nil {
+		return fmt.Errorf("failed to open cache index: %w", err)
+	}
+	defer closeIndex()
+	// Deferred after closeIndex so it runs first, the last hits have to
+	// reach the index before it closes
+	stopMetaHits := StartMetaHits()
+	defer stopMetaHits()
+
+	StartCounters()
+	StartSavings()
+
+	stopTracing, err := StartTracing()
+	if err != nil {
+		return fmt.Errorf("failed to start tracing: %w", err)
+	}
+	defer stopTracing()
+
+	if err := StartUpstream(); err != nil {
+		return fmt.Errorf("failed to build upstream transport: %w", err)
+	}
+
+	configureBandwidth(argsBandwidth())
+	if err := StartAccessLog(); err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	prefetchSlots = make(chan struct{}, args.prefetchWorkers)
+	resetMetricHosts()
+	StartReloader(cmd.Flags())
+
 	StartCron()
+	StartDiskMonitor()
 	StartMetrics()
 	StartHTTP()
 
+	if err := saveCounters(); err != nil {
+		log.Printf("Error saving request counters: %s", err)
+	}
+	if err := saveSavings(); err != nil {
+		log.Printf("Error saving bandwidth savings: %s", err)
+	}
 	return nil
 }
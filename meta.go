@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metaHitInterval is how often hits buffered by recordMetaHit are written
+// to the cache index
+const metaHitInterval = 5 * time.Second
+
+// CacheMeta is what we know about a cache entry besides its body. It is
+// kept in the cache index and, as it was when stored, in
+// <data-dir>/.tenta/meta/<key>.json.
+type CacheMeta struct {
+	Key      string      `json:"key"`
+	URL      string      `json:"url"`
+	CacheKey string      `json:"cache_key"`
+	Size     int64       `json:"size"`
+	StoredAt time.Time   `json:"stored_at"`
+	Header   http.Header `json:"header"`
+
+	Hits       int64     `json:"hits"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// hopHeaders only describe a single connection and are never stored
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Set-Cookie",
+}
+
+func metaDir() string {
+	return filepath.Join(args.dataDir, internalDir, "meta")
+}
+
+func metaPath(key string) string {
+	return filepath.Join(metaDir(), key+".json")
+}
+
+// newCacheMeta records an upstream response that was just cached
+func newCacheMeta(key string, url string, cacheKey string, size int64, header http.Header) CacheMeta {
+	stored := header.Clone()
+	for _, name := range hopHeaders {
+		stored.Del(name)
+	}
+
+	return CacheMeta{
+		Key:        key,
+		URL:        url,
+		CacheKey:   cacheKey,
+		Size:       size,
+		StoredAt:   time.Now().UTC(),
+		Header:     stored,
+		LastAccess: time.Now().UTC(),
+	}
+}
+
+// writeMeta records metadata for a cache entry in the index and in its
+// sidecar file, which the index is rebuilt from. The sidecar is written
+// under a temporary name and renamed so readers never see half of it.
+// The file and size counters follow the index, so two fills of the same
+// key only count once.
+func writeMeta(meta CacheMeta) error {
+	replaced, previousSize, err := indexPut(indexEntry{CacheMeta: meta})
+	if err != nil {
+		return err
+	}
+	if replaced {
+		addSize(meta.Size - previousSize)
+	} else {
+		addSize(meta.Size)
+		incFiles()
+	}
+	if err := os.MkdirAll(metaDir(), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tmp := metaPath(meta.Key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath(meta.Key))
+}
+
+// readMeta looks up metadata for a cache entry in the index. Entries that
+// aren't cached, or were cached by older releases and have none, are
+// reported as os.ErrNotExist.
+func readMeta(key string) (*CacheMeta, error) {
+	entry, err := indexGet(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.NoMeta {
+		return nil, os.ErrNotExist
+	}
+	return &entry.CacheMeta, nil
+}
+
+// readMetaFile loads metadata for a cache entry from its sidecar file
+func readMetaFile(key string) (*CacheMeta, error) {
+	data, err := os.ReadFile(metaPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &CacheMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// metaHit is a hit count and time waiting to be written to the index
+type metaHit struct {
+	hits       int64
+	lastAccess time.Time
+}
+
+// metaHits buffers hits so serving one never waits on a disk write
+var metaHits = struct {
+	sync.Mutex
+	pending map[string]*metaHit
+}{pending: map[string]*metaHit{}}
+
+// recordMetaHit counts a cache hit and its time. They reach the index on
+// the next flushMetaHits; sidecars keep the values from when the entry was
+// stored.
+func recordMetaHit(key string) {
+	metaHits.Lock()
+	defer metaHits.Unlock()
+
+	hit, ok := metaHits.pending[key]
+	if !ok {
+		hit = &metaHit{}
+		metaHits.pending[key] = hit
+	}
+	hit.hits++
+	hit.lastAccess = time.Now().UTC()
+}
+
+// flushMetaHits writes buffered hits to the index. Anything that reports or
+// acts on hits or last access flushes first.
+func flushMetaHits() {
+	metaHits.Lock()
+	pending := metaHits.pending
+	metaHits.pending = map[string]*metaHit{}
+	metaHits.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if err := indexHits(pending); err != nil {
+		log.Printf("Error recording hits on %d entries in the cache index: %s", len(pending), err)
+	}
+}
+
+// StartMetaHits periodically writes buffered hits to the index. The
+// returned func stops it and writes whatever is still buffered.
+func StartMetaHits() func() {
+	ticker := time.NewTicker(metaHitInterval)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				flushMetaHits()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+		flushMetaHits()
+	}
+}
+
+// lastAccess returns when an entry was last served or stored
+func (m *CacheMeta) lastAccess() time.Time {
+	if m.LastAccess.IsZero() {
+		return m.StoredAt
+	}
+	return m.LastAccess
+}
+
+// deleteMeta removes a cache entry from the index along with its
+// metadata, if there is any
+func deleteMeta(key string) {
+	if err := indexDelete(key); err != nil {
+		log.Printf("Error removing %s from the cache index: %s", key, err)
+	}
+	os.Remove(metaPath(key))
+}
+
+// isFresh reports whether a cache entry is still fresh according to the
+// Cache-Control or Expires headers it was stored with. Entries without
+// either never go stale.
+func (m *CacheMeta) isFresh() bool {
+	cc := ParseCacheControl(m.Header.Get("Cache-Control"))
+	lifetime := cc.MaxAge
+	if lifetime < 0 && m.Header.Get("Expires") != "" {
+		// An Expires we can't parse means already expired
+		lifetime = 0
+		if expires, err := http.ParseTime(m.Header.Get("Expires")); err == nil && expires.After(m.StoredAt) {
+			lifetime = int(expires.Sub(m.StoredAt).Seconds())
+		}
+	}
+	if lifetime < 0 {
+		return true
+	}
+
+	// Time the response had already spent in upstream caches
+	if age, err := strconv.Atoi(m.Header.Get("Age")); err == nil {
+		lifetime -= age
+		if lifetime < 0 {
+			lifetime = 0
+		}
+	}
+
+	cc.MaxAge = lifetime
+	return canServeFromCache(m.StoredAt, cc)
+}
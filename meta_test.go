@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheMetaIsFresh(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		storedAt time.Time
+		header   http.Header
+		expected bool
+	}{
+		{
+			name:     "no freshness information",
+			storedAt: now.Add(-24 * time.Hour),
+			header:   http.Header{},
+			expected: true,
+		},
+		{
+			name:     "within max-age",
+			storedAt: now.Add(-30 * time.Second),
+			header:   http.Header{"Cache-Control": []string{"public, max-age=60"}},
+			expected: true,
+		},
+		{
+			name:     "past max-age",
+			storedAt: now.Add(-90 * time.Second),
+			header:   http.Header{"Cache-Control": []string{"max-age=60"}},
+			expected: false,
+		},
+		{
+			name:     "age counts against max-age",
+			storedAt: now.Add(-30 * time.Second),
+			header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Age":           []string{"45"},
+			},
+			expected: false,
+		},
+		{
+			name:     "future expires",
+			storedAt: now,
+			header:   http.Header{"Expires": []string{now.Add(time.Hour).UTC().Format(http.TimeFormat)}},
+			expected: true,
+		},
+		{
+			name:     "invalid expires",
+			storedAt: now,
+			header:   http.Header{"Expires": []string{"0"}},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		meta := CacheMeta{StoredAt: test.storedAt, Header: test.header}
+		if fresh := meta.isFresh(); fresh != test.expected {
+			t.Errorf("%s: expected fresh=%t, got %t", test.name, test.expected, fresh)
+		}
+	}
+}
+
+// TestRecordMetaHit verifies that hits are buffered and reach the index
+// when flushed
+func TestRecordMetaHit(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+	r, err := newKeyRequest("http://dl.example.com/a.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := generateCacheFilename(generateURL(r), r)
+
+	recordMetaHit(key)
+	recordMetaHit(key)
+	if meta, err := readMeta(key); err != nil || meta.Hits != 0 {
+		t.Fatalf("expected hits to wait for a flush, got %+v: %v", meta, err)
+	}
+
+	flushMetaHits()
+	meta, err := readMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Hits != 2 || time.Since(meta.LastAccess) > time.Minute {
+		t.Errorf("expected 2 hits just now, got %d at %s", meta.Hits, meta.LastAccess)
+	}
+
+	// Hits on entries that have since gone are dropped
+	recordMetaHit("12345678")
+	flushMetaHits()
+}
+
+// TestWriteMetaCounters verifies that a second fill of the same key only
+// moves the size counter by the difference
+func TestWriteMetaCounters(t *testing.T) {
+	seedCache(t)
+	files, size := getFilesCount(), getSizeCount()
+
+	if err := writeMeta(CacheMeta{Key: "23456", Size: 10, StoredAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMeta(CacheMeta{Key: "23456", Size: 15, StoredAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getFilesCount() - files; got != 1 {
+		t.Errorf("expected 1 more file, got %d", got)
+	}
+	if got := getSizeCount() - size; got != 15 {
+		t.Errorf("expected 15 more bytes, got %d", got)
+	}
+}
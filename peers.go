@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyHeader carries the chain of tenta instances a request has passed
+// through. Older releases only ever sent the value "true".
+const proxyHeader = "tenta-proxy"
+
+// parseHops returns the instance IDs recorded in a tenta-proxy header value
+func parseHops(header string) []string {
+	hops := []string{}
+	for _, hop := range strings.Split(header, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// isProxyLoop reports whether an incoming request has already been through
+// this instance, or has been forwarded more times than --max-hops allows.
+// Requests chained from a parent or sibling tenta are not loops.
+func isProxyLoop(r *http.Request) bool {
+	header := r.Header.Get(proxyHeader)
+	if header == "" {
+		return false
+	}
+
+	// Legacy tenta instances don't record hops, so we can't tell a chain
+	// from a loop. Keep treating them as a loop like we always have.
+	if header == "true" {
+		return true
+	}
+
+	hops := parseHops(header)
+	for _, hop := range hops {
+		if hop == args.instanceID {
+			return true
+		}
+	}
+
+	return len(hops) >= args.maxHops
+}
+
+// nextHopHeader returns the tenta-proxy value to send upstream, with this
+// instance appended to whatever chain the client request carried
+func nextHopHeader(r *http.Request) string {
+	hops := parseHops(r.Header.Get(proxyHeader))
+	if len(hops) == 1 && hops[0] == "true" {
+		hops = nil
+	}
+	return strings.Join(append(hops, args.instanceID), ",")
+}
+
+// onlyIfCached reports whether the client asked us not to contact upstream
+func onlyIfCached(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.TrimSpace(directive) == "only-if-cached" {
+			return true
+		}
+	}
+	return false
+}
+
+// newPeerRequest builds a request for the same resource on another tenta
+// instance. The original host, scheme and user agent are forwarded so the
+// peer computes the same cache key we do.
+func newPeerRequest(ctx context.Context, method string, peer string, r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(peer, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Host = r.Host
+
+	if scheme := r.Header.Get("Scheme"); scheme != "" {
+		req.Header.Set("Scheme", scheme)
+	}
+	if ua := r.UserAgent(); ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	req.Header.Set(proxyHeader, nextHopHeader(r))
+	req.Header.Add("request-timestamp", fmt.Sprintf("%d", time.Now().Unix()))
+
+	return req, nil
+}
+
+// fetchFromSiblings asks each sibling whether it has the resource cached and
+// fetches it from the first one that does. A nil response means no sibling
+// had it.
+func fetchFromSiblings(ctx context.Context, client *http.Client, r *http.Request) (*http.Response, string) {
+	for _, sibling := range args.siblings {
+		lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(args.siblingTimeout)*time.Millisecond)
+		req, err := newPeerRequest(lookupCtx, http.MethodHead, sibling, r)
+		if err != nil {
+			cancel()
+			log.Printf("Error creating sibling lookup for %s: %s", sibling, err)
+			continue
+		}
+		req.Header.Set("Cache-Control", "only-if-cached")
+
+		resp, err := client.Do(req)
+		cancel()
+		if err != nil {
+			if debugEnabled() {
+				log.Printf("Sibling %s lookup failed: %s", sibling, err)
+			}
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		req, err = newPeerRequest(ctx, http.MethodGet, sibling, r)
+		if err != nil {
+			log.Printf("Error creating sibling request for %s: %s", sibling, err)
+			continue
+		}
+		req.Header.Set("Cache-Control", "only-if-cached")
+
+		resp, err = client.Do(req)
+		if err != nil {
+			log.Printf("Error fetching from sibling %s: %s", sibling, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+
+		incSiblingHits()
+		return resp, sibling
+	}
+
+	return nil, ""
+}
+
+// fetchFromParents sends the request through each configured parent in
+// order. A nil response means every parent failed.
+func fetchFromParents(ctx context.Context, client *http.Client, r *http.Request) (*http.Response, string) {
+	for _, parent := range args.parents {
+		req, err := newPeerRequest(ctx, http.MethodGet, parent, r)
+		if err != nil {
+			log.Printf("Error creating parent request for %s: %s", parent, err)
+			continue
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error fetching from parent %s: %s", parent, err)
+			incErrors()
+			continue
+		}
+
+		incParentFetches()
+		return resp, parent
+	}
+
+	return nil, ""
+}
+
+// fetchUpstream retrieves a cache miss from siblings, then parents, and
+// finally the origin itself. It returns the response and where it came from.
+func fetchUpstream(ctx context.Context, client *http.Client, r *http.Request, url string) (*http.Response, string, error) {
+	if resp, sibling := fetchFromSiblings(ctx, client, r); resp != nil {
+		return resp, "sibling " + sibling, nil
+	}
+
+	if resp, parent := fetchFromParents(ctx, client, r); resp != nil {
+		return resp, "parent " + parent, nil
+	}
+	if len(args.parents) > 0 {
+		log.Printf("All parents failed for %s, falling back to origin", url)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add(proxyHeader, nextHopHeader(r))
+	req.Header.Add("request-timestamp", fmt.Sprintf("%d", time.Now().Unix()))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, "origin", nil
+}
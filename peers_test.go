@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsProxyLoop(t *testing.T) {
+	saveArgs(t)
+	args.instanceID = "cache-a:8080"
+	args.maxHops = 3
+
+	tests := []struct {
+		name     string
+		header   string
+		expected bool
+	}{
+		{
+			name:     "no header",
+			header:   "",
+			expected: false,
+		},
+		{
+			name:     "legacy header",
+			header:   "true",
+			expected: true,
+		},
+		{
+			name:     "chained from parent",
+			header:   "cache-b:8080",
+			expected: false,
+		},
+		{
+			name:     "seen ourselves",
+			header:   "cache-b:8080, cache-a:8080",
+			expected: true,
+		},
+		{
+			name:     "too many hops",
+			header:   "cache-b:8080,cache-c:8080,cache-d:8080",
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		r := &http.Request{Header: http.Header{}}
+		if test.header != "" {
+			r.Header.Set(proxyHeader, test.header)
+		}
+		if loop := isProxyLoop(r); loop != test.expected {
+			t.Errorf("%s: expected loop=%t, got %t", test.name, test.expected, loop)
+		}
+	}
+}
+
+func TestNextHopHeader(t *testing.T) {
+	saveArgs(t)
+	args.instanceID = "cache-a:8080"
+
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{
+			name:     "first hop",
+			header:   "",
+			expected: "cache-a:8080",
+		},
+		{
+			name:     "chained",
+			header:   "cache-b:8080",
+			expected: "cache-b:8080,cache-a:8080",
+		},
+		{
+			name:     "legacy header dropped",
+			header:   "true",
+			expected: "cache-a:8080",
+		},
+	}
+
+	for _, test := range tests {
+		r := &http.Request{Header: http.Header{}}
+		if test.header != "" {
+			r.Header.Set(proxyHeader, test.header)
+		}
+		if header := nextHopHeader(r); header != test.expected {
+			t.Errorf("%s: expected header `%s` doesn't match `%s`", test.name, test.expected, header)
+		}
+	}
+}
+
+// TestSiblingProbe checks that a sibling asking whether we have something
+// gets an answer without it counting as a request or a hit
+func TestSiblingProbe(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+	flushMetaHits()
+	requests, hits := getRequestsCount(), getHitsCount()
+
+	r, err := newKeyRequest("http://dl.example.com/a.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Method = http.MethodHead
+	r.Header.Set("Cache-Control", "only-if-cached")
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected 200 with Content-Length 10, got %d and %q", w.Code, w.Header().Get("Content-Length"))
+	}
+	if getRequestsCount() != requests || getHitsCount() != hits {
+		t.Errorf("expected the probe not to be counted, requests %d -> %d, hits %d -> %d",
+			requests, getRequestsCount(), hits, getHitsCount())
+	}
+	metaHits.Lock()
+	pending := len(metaHits.pending)
+	metaHits.Unlock()
+	if pending != 0 {
+		t.Errorf("expected the probe not to count as a hit on the entry, %d pending", pending)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPrefetchJobs is how many jobs are remembered, finished ones are
+// forgotten oldest first
+const maxPrefetchJobs = 100
+
+// PrefetchRequest is the body of POST /api/prefetch. Headers are sent with
+// every URL, so a User-Agent makes key rules apply as they would for real
+// clients.
+type PrefetchRequest struct {
+	URLs    []string          `json:"urls"`
+	Headers map[string]string `json:"headers"`
+}
+
+// PrefetchResult is the outcome for one URL of a job
+type PrefetchResult struct {
+	URL        string `json:"url"`
+	Key        string `json:"key,omitempty"`
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PrefetchJob tracks a batch of URLs being warmed into the cache
+type PrefetchJob struct {
+	ID         string           `json:"id"`
+	State      string           `json:"state"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Total      int              `json:"total"`
+	Completed  int              `json:"completed"`
+	Failed     int              `json:"failed"`
+	Bytes      int64            `json:"bytes_fetched"`
+	Results    []PrefetchResult `json:"results,omitempty"`
+
+	headers map[string]string
+	cancel  context.CancelFunc
+}
+
+var prefetchJobs = struct {
+	sync.Mutex
+	jobs map[string]*PrefetchJob
+}{jobs: map[string]*PrefetchJob{}}
+
+// prefetchClient stands in for the client address of prefetch requests
+const prefetchClient = "prefetch"
+
+// prefetchSlots bounds how many URLs are fetched at once across all jobs
+var prefetchSlots chan struct{}
+
+func newPrefetchID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// startPrefetch registers a job and starts working through its URLs
+func startPrefetch(request PrefetchRequest) *PrefetchJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &PrefetchJob{
+		ID:        newPrefetchID(),
+		State:     "running",
+		CreatedAt: time.Now().UTC(),
+		Total:     len(request.URLs),
+		Results:   make([]PrefetchResult, len(request.URLs)),
+		headers:   request.Headers,
+		cancel:    cancel,
+	}
+	for i, url := range request.URLs {
+		job.Results[i] = PrefetchResult{URL: url, Status: "pending"}
+	}
+
+	prefetchJobs.Lock()
+	forgetOldPrefetchJobs()
+	prefetchJobs.jobs[job.ID] = job
+	prefetchJobs.Unlock()
+
+	go runPrefetch(ctx, job)
+	return job
+}
+
+// forgetOldPrefetchJobs drops finished jobs beyond maxPrefetchJobs.
+// Callers hold prefetchJobs.
+func forgetOldPrefetchJobs() {
+	finished := []*PrefetchJob{}
+	for _, job := range prefetchJobs.jobs {
+		if job.State != "running" {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+	for len(prefetchJobs.jobs) >= maxPrefetchJobs && len(finished) > 0 {
+		delete(prefetchJobs.jobs, finished[0].ID)
+		finished = finished[1:]
+	}
+}
+
+// acquirePrefetchSlot waits for a free prefetch slot. It returns false,
+// without holding a slot, once ctx is done.
+func acquirePrefetchSlot(ctx context.Context) bool {
+	select {
+	case prefetchSlots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	if ctx.Err() != nil {
+		// Both were ready and select took the slot
+		<-prefetchSlots
+		return false
+	}
+	return true
+}
+
+func runPrefetch(ctx context.Context, job *PrefetchJob) {
+	log.Printf("Prefetch job %s started with %d URLs", job.ID, job.Total)
+
+	var wg sync.WaitGroup
+	for i := range job.Results {
+		if !acquirePrefetchSlot(ctx) {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-prefetchSlots }()
+			prefetchURL(ctx, job, i)
+		}(i)
+	}
+	wg.Wait()
+
+	prefetchJobs.Lock()
+	defer prefetchJobs.Unlock()
+
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.State = "completed"
+	if ctx.Err() != nil {
+		job.State = "cancelled"
+		for i := range job.Results {
+			if job.Results[i].Status == "pending" {
+				job.Results[i].Status = "cancelled"
+			}
+		}
+	}
+	job.cancel()
+	log.Printf("Prefetch job %s %s: %d of %d completed, %d failed, %d bytes",
+		job.ID, job.State, job.Completed, job.Total, job.Failed, job.Bytes)
+}
+
+// prefetchURL warms one URL by sending it through handleRequest, exactly
+// like a client request would
+func prefetchURL(ctx context.Context, job *PrefetchJob, i int) {
+	result := PrefetchResult{URL: job.Results[i].URL, Status: "running"}
+	setPrefetchResult(job, i, result, false)
+
+	r, err := newKeyRequest(result.URL, job.headers["User-Agent"])
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+		setPrefetchResult(job, i, result, true)
+		return
+	}
+	for name, value := range job.headers {
+		r.Header.Set(name, value)
+	}
+	r.RemoteAddr = prefetchClient
+	r.RequestURI = r.URL.RequestURI()
+	r = r.WithContext(ctx)
+
+	result.Key = generateCacheFilename(generateURL(r), r)
+	if cacheFileExists(result.Key) {
+		result.Status = "already_cached"
+		setPrefetchResult(job, i, result, true)
+		return
+	}
+
+	w := &discardResponseWriter{header: http.Header{}}
+	handleRequest(w, r)
+
+	result.StatusCode = w.status()
+	result.Bytes = w.written
+	switch {
+	case result.StatusCode != http.StatusOK:
+		result.Status = "error"
+		result.Error = fmt.Sprintf("upstream returned %d", result.StatusCode)
+	case !cacheFileExists(result.Key):
+		// Passed through, too large or the fill failed
+		result.Status = "error"
+		result.Error = "response was not cached"
+	default:
+		result.Status = "fetched"
+	}
+	setPrefetchResult(job, i, result, true)
+}
+
+func cacheFileExists(key string) bool {
+	_, err := indexGet(key)
+	return err == nil
+}
+
+func setPrefetchResult(job *PrefetchJob, i int, result PrefetchResult, done bool) {
+	prefetchJobs.Lock()
+	defer prefetchJobs.Unlock()
+
+	job.Results[i] = result
+	if !done {
+		return
+	}
+	if result.Status == "error" {
+		job.Failed++
+	} else {
+		job.Completed++
+	}
+	job.Bytes += result.Bytes
+}
+
+// discardResponseWriter stands in for a client during prefetches
+type discardResponseWriter struct {
+	header  http.Header
+	code    int
+	written int64
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) WriteHeader(code int) {
+	if d.code == 0 {
+		d.code = code
+	}
+}
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	d.written += int64(len(p))
+	return len(p), nil
+}
+
+func (d *discardResponseWriter) status() int {
+	if d.code == 0 {
+		return http.StatusOK
+	}
+	return d.code
+}
+
+// prefetchSnapshot copies a job so it can be encoded without holding the lock
+func prefetchSnapshot(job *PrefetchJob, withResults bool) PrefetchJob {
+	snapshot := *job
+	snapshot.Results = nil
+	if withResults {
+		snapshot.Results = append([]PrefetchResult{}, job.Results...)
+	}
+	return snapshot
+}
+
+// handlePrefetch starts prefetch jobs and lists them
+func handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		prefetchJobs.Lock()
+		jobs := []PrefetchJob{}
+		for _, job := range prefetchJobs.jobs {
+			jobs = append(jobs, prefetchSnapshot(job, false))
+		}
+		prefetchJobs.Unlock()
+
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count": len(jobs),
+			"jobs":  jobs,
+		})
+
+	case http.MethodPost:
+		request := PrefetchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Invalid prefetch request: %s", err.Error()),
+			})
+			return
+		}
+		if len(request.URLs) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "urls must not be empty",
+			})
+			return
+		}
+		for _, url := range request.URLs {
+			if _, err := newKeyRequest(url, ""); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": fmt.Sprintf("Invalid url: %s", err.Error()),
+				})
+				return
+			}
+		}
+
+		job := startPrefetch(request)
+		prefetchJobs.Lock()
+		snapshot := prefetchSnapshot(job, false)
+		prefetchJobs.Unlock()
+
+		w.Header().Set("Location", "/api/prefetch/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(snapshot)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only GET and POST methods allowed",
+		})
+	}
+}
+
+// handlePrefetchJob reports on one job, or cancels it with DELETE
+func handlePrefetchJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/prefetch/")
+	prefetchJobs.Lock()
+	job, ok := prefetchJobs.jobs[id]
+	prefetchJobs.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Prefetch job not found",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		// URLs already downloading are allowed to finish
+		job.cancel()
+		log.Printf("Prefetch job %s cancelled", id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only GET and DELETE methods allowed",
+		})
+		return
+	}
+
+	prefetchJobs.Lock()
+	snapshot := prefetchSnapshot(job, true)
+	prefetchJobs.Unlock()
+	json.NewEncoder(w).Encode(snapshot)
+}
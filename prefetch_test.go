@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPrefetch warms a mix of new, already cached and failing URLs and
+// checks the job's per-URL results
+func TestPrefetch(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.pkg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	seedCache(t, origin.URL+"/cached.pkg")
+	setupUpstream(t)
+	prefetchSlots = make(chan struct{}, 2)
+
+	requests, misses := getRequestsCount(), getMissesCount()
+	job := startPrefetch(PrefetchRequest{
+		URLs: []string{
+			origin.URL + "/new.pkg",
+			origin.URL + "/cached.pkg",
+			origin.URL + "/missing.pkg",
+		},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prefetchJobs.Lock()
+		snapshot := prefetchSnapshot(job, true)
+		prefetchJobs.Unlock()
+		if snapshot.State != "running" {
+			job = &snapshot
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prefetch job did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if job.State != "completed" || job.Completed != 2 || job.Failed != 1 || job.Bytes != 10 {
+		t.Errorf("expected 2 completed, 1 failed, 10 bytes, got %+v", job)
+	}
+	expected := []string{"fetched", "already_cached", "error"}
+	for i, status := range expected {
+		if job.Results[i].Status != status {
+			t.Errorf("%s: expected %s, got %s", job.Results[i].URL, status, job.Results[i].Status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(args.dataDir, job.Results[0].Key)); err != nil {
+		t.Errorf("prefetched URL was not cached: %s", err)
+	}
+	if getRequestsCount() != requests || getMissesCount() != misses {
+		t.Errorf("expected prefetches not to be counted as client requests, requests %d -> %d, misses %d -> %d",
+			requests, getRequestsCount(), misses, getMissesCount())
+	}
+}
+
+// TestAcquirePrefetchSlotCancelled verifies that a cancelled job never keeps
+// a slot, even when a slot was free at the same time
+func TestAcquirePrefetchSlotCancelled(t *testing.T) {
+	prefetchSlots = make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 100; i++ {
+		if acquirePrefetchSlot(ctx) {
+			t.Fatal("expected no slot for a cancelled job")
+		}
+	}
+	if len(prefetchSlots) != 0 {
+		t.Errorf("expected the slot to be free, %d held", len(prefetchSlots))
+	}
+}
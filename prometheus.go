@@ -2,9 +2,10 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -14,14 +15,28 @@ import (
 )
 
 var (
-	tentaRequests  prometheus.Counter
-	tentaHits      prometheus.Counter
-	tentaMisses    prometheus.Counter
-	tentaFiles     prometheus.Gauge
-	tentaSize      prometheus.Gauge
-	tentaErrors    prometheus.Counter
-	tentaNotFound  prometheus.Counter
-	tentaServerErr prometheus.Counter
+	tentaRequests      prometheus.Counter
+	tentaHits          prometheus.Counter
+	tentaMisses        prometheus.Counter
+	tentaFiles         prometheus.Gauge
+	tentaSize          prometheus.Gauge
+	tentaErrors        prometheus.Counter
+	tentaNotFound      prometheus.Counter
+	tentaServerErr     prometheus.Counter
+	tentaSiblingHits   prometheus.Counter
+	tentaParentFetches prometheus.Counter
+
+	tentaUpstreamConnsOpen   prometheus.Gauge
+	tentaUpstreamDials       prometheus.Counter
+	tentaUpstreamDialErrors  prometheus.Counter
+	tentaUpstreamConnsReused prometheus.Counter
+	tentaUpstreamInFlight    prometheus.Gauge
+	tentaUpstreamRetries     prometheus.Counter
+	tentaResumedBytes        prometheus.Counter
+	tentaBytesServed         prometheus.Counter
+
+	tentaBandwidthLimit     *prometheus.GaugeVec
+	tentaBandwidthThrottled *prometheus.CounterVec
 
 	// Atomic counters for API access
 	requestsCount  int64
@@ -32,6 +47,7 @@ var (
 	serverErrCount int64
 	filesCount     int64
 	sizeCount      int64
+	servedCount    int64
 )
 
 func init() {
@@ -67,6 +83,54 @@ func init() {
 		Name: "tenta_server_errors",
 		Help: "The total number of 5xx responses",
 	})
+	tentaSiblingHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_sibling_hits",
+		Help: "The total number of misses served from a sibling cache",
+	})
+	tentaParentFetches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_parent_fetches",
+		Help: "The total number of misses fetched through a parent proxy",
+	})
+	tentaUpstreamConnsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tenta_upstream_connections_open",
+		Help: "The number of open upstream connections, idle or in use",
+	})
+	tentaUpstreamDials = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_upstream_dials",
+		Help: "The total number of new upstream connections",
+	})
+	tentaUpstreamDialErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_upstream_dial_errors",
+		Help: "The total number of failed upstream connection attempts",
+	})
+	tentaUpstreamConnsReused = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_upstream_connections_reused",
+		Help: "The total number of upstream requests served by a pooled connection",
+	})
+	tentaUpstreamInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tenta_upstream_requests_in_flight",
+		Help: "The number of upstream requests waiting for response headers",
+	})
+	tentaUpstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_upstream_retries",
+		Help: "The total number of retried or resumed upstream downloads",
+	})
+	tentaResumedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_resumed_bytes",
+		Help: "The total number of bytes not downloaded again thanks to resuming",
+	})
+	tentaBytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_bytes_served",
+		Help: "The total number of bytes sent to clients",
+	})
+	tentaBandwidthLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenta_bandwidth_limit_bytes_per_second",
+		Help: "The configured bandwidth limit, 0 means unlimited",
+	}, []string{"scope"})
+	tentaBandwidthThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenta_bandwidth_throttled_seconds",
+		Help: "The total time transfers spent waiting on a bandwidth limit",
+	}, []string{"scope"})
 }
 
 // Helper functions for cache API
@@ -100,6 +164,67 @@ func incServerErr() {
 	atomic.AddInt64(&serverErrCount, 1)
 }
 
+func incSiblingHits() {
+	tentaSiblingHits.Inc()
+}
+
+func incParentFetches() {
+	tentaParentFetches.Inc()
+}
+
+func incUpstreamConnsOpen() {
+	tentaUpstreamConnsOpen.Inc()
+}
+
+func decUpstreamConnsOpen() {
+	tentaUpstreamConnsOpen.Dec()
+}
+
+func incUpstreamDials() {
+	tentaUpstreamDials.Inc()
+}
+
+func incUpstreamDialErrors() {
+	tentaUpstreamDialErrors.Inc()
+}
+
+func incUpstreamConnsReused() {
+	tentaUpstreamConnsReused.Inc()
+}
+
+func incUpstreamInFlight() {
+	tentaUpstreamInFlight.Inc()
+}
+
+func decUpstreamInFlight() {
+	tentaUpstreamInFlight.Dec()
+}
+
+func incUpstreamRetries() {
+	tentaUpstreamRetries.Inc()
+}
+
+func addResumedBytes(size int64) {
+	tentaResumedBytes.Add(float64(size))
+}
+
+func addBytesServed(size int64) {
+	tentaBytesServed.Add(float64(size))
+	atomic.AddInt64(&servedCount, size)
+}
+
+func setBandwidthLimitMetrics(limits BandwidthLimits) {
+	tentaBandwidthLimit.WithLabelValues("origin").Set(float64(limits.Origin))
+	tentaBandwidthLimit.WithLabelValues("origin_host").Set(float64(limits.OriginHost))
+	tentaBandwidthLimit.WithLabelValues("client").Set(float64(limits.Client))
+}
+
+func addBandwidthThrottled(scope string, waited time.Duration) {
+	if waited > 0 {
+		tentaBandwidthThrottled.WithLabelValues(scope).Add(waited.Seconds())
+	}
+}
+
 func getRequestsCount() int64 {
 	return atomic.LoadInt64(&requestsCount)
 }
@@ -124,6 +249,10 @@ func getServerErrCount() int64 {
 	return atomic.LoadInt64(&serverErrCount)
 }
 
+func getBytesServed() int64 {
+	return atomic.LoadInt64(&servedCount)
+}
+
 func incFiles() {
 	tentaFiles.Inc()
 	atomic.AddInt64(&filesCount, 1)
@@ -152,36 +281,69 @@ func getSizeCount() int64 {
 	return atomic.LoadInt64(&sizeCount)
 }
 
-func StartMetrics() {
-	go func() {
-		port := fmt.Sprintf(":%d", 2112)
+// scanComplete is set once the cache index is ready and the file and size
+// metrics reflect it
+var scanComplete int32
 
-		if args.debug {
-			log.Println("Repopulating prometheus metrics from data directory")
-		}
+func isScanComplete() bool {
+	return atomic.LoadInt32(&scanComplete) == 1
+}
 
-		tmpfiles, err := ioutil.ReadDir(args.dataDir)
-		if err != nil {
-			log.Fatalf("Error reading data dir %s: %s", args.dataDir, err)
-		}
+// setCacheTotals sets the file and size metrics from the cache index
+func setCacheTotals(files int64, size int64) {
+	tentaFiles.Set(float64(files))
+	tentaSize.Set(float64(size))
+	atomic.StoreInt64(&filesCount, files)
+	atomic.StoreInt64(&sizeCount, size)
+}
 
-		for _, file := range tmpfiles {
-			if file.Mode().IsRegular() {
-				incFiles()
-				addSize(file.Size())
-			}
-		}
+// metricsHandler serves the Prometheus metrics
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// metricsOnAdmin reports whether /metrics is served by the admin listener
+func metricsOnAdmin() bool {
+	return args.metricsEnabled && args.metricsOnAdmin
+}
 
-		log.Printf("Starting metrics server on %s", port)
+// validateMetrics checks the metrics listener flags
+func validateMetrics() error {
+	if !strings.HasPrefix(args.metricsPath, "/") || args.metricsPath == "/" || strings.HasPrefix(args.metricsPath, "/api/") {
+		return fmt.Errorf("metrics-path must start with / and not be / or under /api/, got %q", args.metricsPath)
+	}
+	if metricsOnAdmin() && args.adminAddr == "" {
+		return fmt.Errorf("metrics-on-admin requires admin-addr")
+	}
+	return nil
+}
 
-		s := &http.Server{
-			Addr:           port,
-			Handler:        promhttp.Handler(),
-			ReadTimeout:    60 * time.Second,
-			WriteTimeout:   60 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		}
+// StartMetrics starts the metrics listener. Metrics that can't be served
+// are logged, the cache keeps running.
+func StartMetrics() {
+	if !args.metricsEnabled || metricsOnAdmin() {
+		return
+	}
 
-		log.Fatal(s.ListenAndServe())
+	mux := http.NewServeMux()
+	mux.Handle(args.metricsPath, metricsHandler())
+	s := &http.Server{
+		Addr:           args.metricsAddr,
+		Handler:        mux,
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	listener, err := net.Listen("tcp", args.metricsAddr)
+	if err != nil {
+		log.Printf("Error starting metrics server, metrics are not served: %s", err)
+		return
+	}
+	log.Printf("Starting metrics server on %s%s", args.metricsAddr, args.metricsPath)
+	go func() {
+		if err := s.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %s", err)
+		}
 	}()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartMetrics(t *testing.T) {
+	saveArgs(t)
+	args.metricsEnabled = true
+	args.metricsOnAdmin = false
+	args.metricsPath = "/custom-metrics"
+
+	// An address that's taken is logged, not fatal
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	args.metricsAddr = taken.Addr().String()
+	StartMetrics()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.metricsAddr = free.Addr().String()
+	free.Close()
+	StartMetrics()
+
+	var body []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + args.metricsAddr + "/custom-metrics")
+		if err == nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics server did not start: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(string(body), "tenta_requests_received") {
+		t.Errorf("expected tenta metrics, got %q", body)
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	saveArgs(t)
+	defer func() {
+		args.metricsPath = "/metrics"
+		args.metricsOnAdmin = false
+		args.adminAddr = ""
+	}()
+
+	tests := []struct {
+		path    string
+		onAdmin bool
+		admin   string
+		valid   bool
+	}{
+		{"/metrics", false, "", true},
+		{"/prom", true, "127.0.0.1:9090", true},
+		{"metrics", false, "", false},
+		{"/", false, "", false},
+		{"/api/metrics", false, "", false},
+		{"/metrics", true, "", false},
+	}
+	for _, test := range tests {
+		args.metricsPath = test.path
+		args.metricsOnAdmin = test.onAdmin
+		args.adminAddr = test.admin
+		if err := validateMetrics(); (err == nil) != test.valid {
+			t.Errorf("path=%s on-admin=%t admin-addr=%q: expected valid=%t, got %v", test.path, test.onAdmin, test.admin, test.valid, err)
+		}
+	}
+}
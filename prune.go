@@ -15,27 +15,23 @@ type OldFileEntry struct {
 	Size int64
 }
 
-func findOldFiles(dir string) (files []OldFileEntry, err error) {
-	tmpfiles, err := os.ReadDir(dir)
+// findOldFiles returns the entries stored longer than --max-cache-age ago,
+// according to the cache index
+func findOldFiles() (files []OldFileEntry, err error) {
+	entries, err := indexEntries()
 	if err != nil {
 		return
 	}
 
-	for _, file := range tmpfiles {
-		if !file.IsDir() {
-			fileInfo, err := file.Info()
-			if err != nil {
-				continue
-			}
-			if time.Since(fileInfo.ModTime()) > time.Duration(args.maxCacheAge)*time.Hour {
-				if args.debug {
-					log.Printf("Found old file %s with mod time of %d", file.Name(), fileInfo.ModTime().Unix())
-				}
-				files = append(files, OldFileEntry{
-					Name: file.Name(),
-					Size: fileInfo.Size(),
-				})
+	for _, entry := range entries {
+		if time.Since(entry.StoredAt) > time.Duration(args.maxCacheAge)*time.Hour {
+			if debugEnabled() {
+				log.Printf("Found old file %s stored at %d", entry.Key, entry.StoredAt.Unix())
 			}
+			files = append(files, OldFileEntry{
+				Name: entry.Key,
+				Size: entry.Size,
+			})
 		}
 	}
 	return
@@ -43,24 +39,33 @@ func findOldFiles(dir string) (files []OldFileEntry, err error) {
 
 func deleteFiles(path string, files []OldFileEntry) {
 	log.Printf("Deleting %d old files\n", len(files))
+	var freed int64
+	deleted := 0
 	for _, file := range files {
 		fullPath := filepath.Join(path, file.Name)
-		if args.debug {
+		if debugEnabled() {
 			log.Printf("Deleting %s", fullPath)
 		}
 		err := os.Remove(fullPath)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			log.Printf("Error deleting %s: %s\n", fullPath, err)
 			incErrors()
+			// Still on disk, so it stays in the index and the counters
+			continue
 		}
 		subSize(file.Size)
 		decFiles()
+		publishEviction(file.Name, file.Size, "prune")
+		deleteMeta(file.Name)
+		freed += file.Size
+		deleted++
 	}
+	publishEvent(Event{Type: eventPrune, Files: deleted, Size: freed})
 }
 
 func pruneFiles() {
 	log.Printf("Pruning old files in %s\n", args.dataDir)
-	files, err := findOldFiles(args.dataDir)
+	files, err := findOldFiles()
 	if err != nil {
 		log.Printf("Error finding old files: %s", err)
 		incErrors()
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxPurgeKeys caps how many keys a purge response lists individually
+const maxPurgeKeys = 1000
+
+// PurgeResponse reports the outcome of a purge
+type PurgeResponse struct {
+	Status        string   `json:"status"`
+	DryRun        bool     `json:"dry_run"`
+	Matched       int      `json:"matched"`
+	Deleted       int      `json:"deleted"`
+	BytesFreed    int64    `json:"bytes_freed"`
+	Errors        int      `json:"errors"`
+	Keys          []string `json:"keys"`
+	Unmapped      []string `json:"unmapped"`
+	UnmappedCount int      `json:"unmapped_count"`
+}
+
+// purgeMatcher decides whether a cached URL should be purged
+type purgeMatcher func(url string) bool
+
+// newPurgeMatcher builds a matcher from exactly one of the host, prefix or
+// regex query parameters
+func newPurgeMatcher(query neturl.Values) (purgeMatcher, error) {
+	selectors := 0
+	for _, name := range []string{"url", "host", "prefix", "regex"} {
+		if query.Get(name) != "" {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		return nil, fmt.Errorf("exactly one of url, host, prefix or regex is required")
+	}
+
+	if host := strings.ToLower(query.Get("host")); host != "" {
+		return func(url string) bool {
+			u, err := neturl.Parse(url)
+			if err != nil {
+				return false
+			}
+			// "dl.example.com" matches with or without a port
+			return strings.ToLower(u.Host) == host || strings.ToLower(u.Hostname()) == host
+		}, nil
+	}
+
+	if prefix := query.Get("prefix"); prefix != "" {
+		return func(url string) bool {
+			return strings.HasPrefix(url, prefix)
+		}, nil
+	}
+
+	if expr := query.Get("regex"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return re.MatchString, nil
+	}
+
+	return nil, nil
+}
+
+// removeCacheEntry deletes a cache file and its metadata, keeping the
+// size and file count metrics in step. reason is reported with the
+// eviction event.
+func removeCacheEntry(key string, size int64, reason string) error {
+	if err := os.Remove(filepath.Join(args.dataDir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	subSize(size)
+	decFiles()
+	publishEviction(key, size, reason)
+	deleteMeta(key)
+	return nil
+}
+
+// purgeEntry deletes one matched entry, or just counts it on a dry run
+func purgeEntry(response *PurgeResponse, key string, size int64) {
+	response.Matched++
+	if len(response.Keys) < maxPurgeKeys {
+		response.Keys = append(response.Keys, key)
+	}
+	if response.DryRun {
+		response.BytesFreed += size
+		return
+	}
+
+	if err := removeCacheEntry(key, size, "purge"); err != nil {
+		log.Printf("Error purging %s: %s", key, err)
+		incErrors()
+		response.Errors++
+		return
+	}
+	response.Deleted++
+	response.BytesFreed += size
+}
+
+// handleCachePurge deletes cache entries by exact URL, host, URL prefix or
+// URL regex. Entries without metadata can't be matched against a URL and
+// are listed as unmapped instead.
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only POST and DELETE methods allowed",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	matcher, err := newPurgeMatcher(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+	response := PurgeResponse{
+		Status:   "purged",
+		DryRun:   dryRun,
+		Keys:     []string{},
+		Unmapped: []string{},
+	}
+	if dryRun {
+		response.Status = "dry_run"
+	}
+
+	// An exact URL maps straight to its key, no scan needed
+	if rawURL := query.Get("url"); rawURL != "" {
+		keyRequest, err := newKeyRequest(rawURL, query.Get("ua"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("Invalid url: %s", err.Error()),
+			})
+			return
+		}
+		key := generateCacheFilename(generateURL(keyRequest), keyRequest)
+		if entry, err := indexGet(key); err == nil {
+			purgeEntry(&response, key, entry.Size)
+		}
+		logPurge(r, response)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	entries, err := indexEntries()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Error reading cache index: %s", err.Error()),
+		})
+		incErrors()
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.NoMeta {
+			response.UnmappedCount++
+			if len(response.Unmapped) < maxPurgeKeys {
+				response.Unmapped = append(response.Unmapped, entry.Key)
+			}
+			continue
+		}
+
+		if matcher(entry.URL) {
+			purgeEntry(&response, entry.Key, entry.Size)
+		}
+	}
+
+	logPurge(r, response)
+	json.NewEncoder(w).Encode(response)
+}
+
+func logPurge(r *http.Request, response PurgeResponse) {
+	log.Printf("Purge %s (dry run %t): matched %d, deleted %d, freed %d bytes, %d unmapped",
+		r.URL.RawQuery, response.DryRun, response.Matched, response.Deleted, response.BytesFreed, response.UnmappedCount)
+}
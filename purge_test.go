@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// seedCache writes cache entries with metadata for the given URLs, plus one
+// entry without metadata
+func seedCache(t *testing.T, urls ...string) {
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	openTestIndex(t)
+	for _, url := range urls {
+		r, err := newKeyRequest(url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := generateCacheFilename(generateURL(r), r)
+		if err := os.WriteFile(filepath.Join(args.dataDir, key), []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeMeta(newCacheMeta(key, url, url, 10, http.Header{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(args.dataDir, "12345"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files written behind tenta's back only show up once the index is rebuilt
+	if _, _, err := rebuildCacheIndex(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func purge(t *testing.T, query string) PurgeResponse {
+	w := httptest.NewRecorder()
+	handleCachePurge(w, httptest.NewRequest(http.MethodPost, "/api/cache/purge?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+	}
+
+	response := PurgeResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestCachePurge(t *testing.T) {
+	seedCache(t,
+		"http://dl.example.com/a.pkg",
+		"http://dl.example.com:8080/b.pkg",
+		"http://cdn.example.org/depot/1/c.pkg",
+		"http://cdn.example.org/depot/2/d.pkg",
+	)
+
+	dryRun := purge(t, "host=dl.example.com&dry_run=true")
+	if dryRun.Matched != 2 || dryRun.Deleted != 0 || dryRun.BytesFreed != 20 {
+		t.Errorf("dry run: expected 2 matched, 0 deleted, 20 bytes, got %+v", dryRun)
+	}
+	if dryRun.UnmappedCount != 1 || dryRun.Unmapped[0] != "12345" {
+		t.Errorf("dry run: expected the legacy entry to be unmapped, got %+v", dryRun.Unmapped)
+	}
+
+	if host := purge(t, "host=dl.example.com"); host.Deleted != 2 {
+		t.Errorf("host: expected 2 deleted, got %+v", host)
+	}
+	if prefix := purge(t, "prefix=http://cdn.example.org/depot/1/"); prefix.Deleted != 1 {
+		t.Errorf("prefix: expected 1 deleted, got %+v", prefix)
+	}
+	if regex := purge(t, `regex=d\.pkg$`); regex.Deleted != 1 {
+		t.Errorf("regex: expected 1 deleted, got %+v", regex)
+	}
+
+	files, _ := os.ReadDir(args.dataDir)
+	for _, file := range files {
+		if !file.IsDir() && file.Name() != "12345" {
+			t.Errorf("expected only the legacy entry to remain, found %s", file.Name())
+		}
+	}
+}
+
+func TestCachePurgeURL(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg")
+
+	if response := purge(t, "url=http://dl.example.com/a.pkg"); response.Deleted != 1 || response.BytesFreed != 10 {
+		t.Errorf("expected the URL to be purged, got %+v", response)
+	}
+	if response := purge(t, "url=http://dl.example.com/a.pkg"); response.Matched != 0 {
+		t.Errorf("expected nothing left to purge, got %+v", response)
+	}
+}
+
+func TestCachePurgeBadRequest(t *testing.T) {
+	for _, query := range []string{"", "host=a&prefix=b", "regex=("} {
+		w := httptest.NewRecorder()
+		handleCachePurge(w, httptest.NewRequest(http.MethodPost, "/api/cache/purge?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a byte rate limiter whose rate can be changed at runtime.
+// A rate of 0 means unlimited. Callers may overdraw the bucket by one
+// request, which keeps large writes on slow limits from waiting forever.
+type tokenBucket struct {
+	mu          sync.Mutex
+	rate        float64
+	tokens      float64
+	last        time.Time
+	lastUsed    time.Time
+	highWaiting int
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	b := &tokenBucket{last: time.Now(), lastUsed: time.Now()}
+	b.setRate(rate)
+	return b
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *tokenBucket) getRate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// refill adds the tokens earned since the last call, up to one second's worth
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// wait blocks until n bytes may be sent. Low priority callers also wait
+// while any high priority caller is queued.
+func (b *tokenBucket) wait(ctx context.Context, n int, high bool, prioritize bool) (time.Duration, error) {
+	start := time.Now()
+	queued := false
+	defer func() {
+		if queued {
+			b.mu.Lock()
+			b.highWaiting--
+			b.mu.Unlock()
+		}
+	}()
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.lastUsed = now
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return now.Sub(start), nil
+		}
+		b.refill(now)
+
+		var delay time.Duration
+		switch {
+		case prioritize && !high && b.highWaiting > 0:
+			delay = 10 * time.Millisecond
+		case b.tokens >= 0:
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return now.Sub(start), nil
+		default:
+			delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+			if prioritize && high && !queued {
+				queued = true
+				b.highWaiting++
+			}
+		}
+		b.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return time.Since(start), ctx.Err()
+		}
+	}
+}
+
+// bandwidthLimiter holds every bucket tenta shapes traffic with
+type bandwidthLimiter struct {
+	mu             sync.Mutex
+	origin         *tokenBucket
+	originHostRate int64
+	originHosts    map[string]int64
+	hostBuckets    map[string]*tokenBucket
+	clientRate     int64
+	clientBuckets  map[string]*tokenBucket
+	hitPriority    bool
+	lastSweep      time.Time
+}
+
+// BandwidthLimits is the runtime view of the limits, as used by /api/limits.
+// All rates are in bytes per second and 0 means unlimited.
+type BandwidthLimits struct {
+	Origin        int64            `json:"origin_bytes_per_second"`
+	OriginHost    int64            `json:"origin_host_bytes_per_second"`
+	OriginHosts   map[string]int64 `json:"origin_hosts_bytes_per_second"`
+	Client        int64            `json:"client_bytes_per_second"`
+	HitPriority   bool             `json:"hit_priority"`
+	ActiveHosts   int              `json:"active_host_buckets"`
+	ActiveClients int              `json:"active_client_buckets"`
+}
+
+var bandwidth = &bandwidthLimiter{
+	origin:        newTokenBucket(0),
+	originHosts:   map[string]int64{},
+	hostBuckets:   map[string]*tokenBucket{},
+	clientBuckets: map[string]*tokenBucket{},
+}
+
+// configureBandwidth applies new limits. Existing buckets are updated in
+// place so in-flight transfers pick the change up immediately.
+func configureBandwidth(limits BandwidthLimits) {
+	bandwidth.mu.Lock()
+	defer bandwidth.mu.Unlock()
+
+	bandwidth.origin.setRate(limits.Origin)
+	bandwidth.originHostRate = limits.OriginHost
+	bandwidth.originHosts = map[string]int64{}
+	for host, rate := range limits.OriginHosts {
+		bandwidth.originHosts[host] = rate
+	}
+	for host, bucket := range bandwidth.hostBuckets {
+		bucket.setRate(bandwidth.hostRate(host))
+	}
+	bandwidth.clientRate = limits.Client
+	for _, bucket := range bandwidth.clientBuckets {
+		bucket.setRate(limits.Client)
+	}
+	bandwidth.hitPriority = limits.HitPriority
+
+	setBandwidthLimitMetrics(limits)
+}
+
+// validateBandwidth checks that no limit is negative
+func validateBandwidth(limits BandwidthLimits) error {
+	if limits.Origin < 0 || limits.OriginHost < 0 || limits.Client < 0 {
+		return fmt.Errorf("bandwidth limits must be >= 0")
+	}
+	for host, rate := range limits.OriginHosts {
+		if rate < 0 {
+			return fmt.Errorf("bandwidth limit for %s must be >= 0, got %d", host, rate)
+		}
+	}
+	return nil
+}
+
+// currentBandwidth returns the limits currently in effect
+func currentBandwidth() BandwidthLimits {
+	bandwidth.mu.Lock()
+	defer bandwidth.mu.Unlock()
+
+	limits := BandwidthLimits{
+		Origin:        bandwidth.origin.getRate(),
+		OriginHost:    bandwidth.originHostRate,
+		OriginHosts:   map[string]int64{},
+		Client:        bandwidth.clientRate,
+		HitPriority:   bandwidth.hitPriority,
+		ActiveHosts:   len(bandwidth.hostBuckets),
+		ActiveClients: len(bandwidth.clientBuckets),
+	}
+	for host, rate := range bandwidth.originHosts {
+		limits.OriginHosts[host] = rate
+	}
+	return limits
+}
+
+// hostRate returns the limit for an origin host. Callers hold mu.
+func (l *bandwidthLimiter) hostRate(host string) int64 {
+	if rate, ok := l.originHosts[host]; ok {
+		return rate
+	}
+	return l.originHostRate
+}
+
+// sweep drops buckets nobody has used for a while. Callers hold mu.
+func (l *bandwidthLimiter) sweep() {
+	if time.Since(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = time.Now()
+
+	for _, buckets := range []map[string]*tokenBucket{l.hostBuckets, l.clientBuckets} {
+		for key, bucket := range buckets {
+			bucket.mu.Lock()
+			idle := time.Since(bucket.lastUsed) > 10*time.Minute
+			bucket.mu.Unlock()
+			if idle {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+func (l *bandwidthLimiter) hostBucket(host string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep()
+
+	bucket, ok := l.hostBuckets[host]
+	if !ok {
+		bucket = newTokenBucket(l.hostRate(host))
+		l.hostBuckets[host] = bucket
+	}
+	return bucket
+}
+
+func (l *bandwidthLimiter) clientBucket(ip string) (*tokenBucket, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep()
+
+	bucket, ok := l.clientBuckets[ip]
+	if !ok {
+		bucket = newTokenBucket(l.clientRate)
+		l.clientBuckets[ip] = bucket
+	}
+	return bucket, l.hitPriority
+}
+
+// originReader shapes an upstream response body against the global and
+// per-host origin limits
+type originReader struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	host    *tokenBucket
+	waiting int32
+}
+
+// limitOriginBody applies the origin bandwidth limits to resp's body.
+// Sibling traffic stays on the LAN and isn't limited.
+func limitOriginBody(resp *http.Response) {
+	if onlyIfCached(resp.Request) {
+		return
+	}
+
+	host := resp.Request.Host
+	if host == "" {
+		host = resp.Request.URL.Host
+	}
+	resp.Body = &originReader{
+		body: resp.Body,
+		ctx:  resp.Request.Context(),
+		host: bandwidth.hostBucket(host),
+	}
+}
+
+func (o *originReader) Read(p []byte) (int, error) {
+	n, err := o.body.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(&o.waiting, 1)
+		defer atomic.StoreInt32(&o.waiting, 0)
+
+		waited, waitErr := bandwidth.origin.wait(o.ctx, n, false, false)
+		addBandwidthThrottled("origin", waited)
+		if waitErr == nil {
+			waited, waitErr = o.host.wait(o.ctx, n, false, false)
+			addBandwidthThrottled("origin_host", waited)
+		}
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttled reports whether the reader is currently held back by a limit
+func (o *originReader) throttled() bool {
+	return atomic.LoadInt32(&o.waiting) == 1
+}
+
+func (o *originReader) Close() error {
+	return o.body.Close()
+}
+
+// clientWriter shapes and accounts a response to one client. Cache hits
+// are sent with priority over misses and pass-through traffic when
+// --limit-hit-priority is set.
+type clientWriter struct {
+	http.ResponseWriter
+	ip         string
+	ctx        context.Context
+	bucket     *tokenBucket
+	hit        bool
+	prioritize bool
+}
+
+// limitClientWriter applies the per-client bandwidth limit to w
+func limitClientWriter(w http.ResponseWriter, r *http.Request, hit bool) http.ResponseWriter {
+	ip := clientIP(r)
+	bucket, prioritize := bandwidth.clientBucket(ip)
+	return &clientWriter{
+		ResponseWriter: w,
+		ip:             ip,
+		ctx:            r.Context(),
+		bucket:         bucket,
+		hit:            hit,
+		prioritize:     prioritize,
+	}
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	waited, err := c.bucket.wait(c.ctx, len(p), c.hit, c.prioritize)
+	addBandwidthThrottled("client", waited)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.ResponseWriter.Write(p)
+	recordClientBytes(c.ip, int64(n))
+	if c.ip != prefetchClient {
+		addBytesServed(int64(n))
+	}
+	return n, err
+}
+
+func (c *clientWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
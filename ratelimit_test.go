@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestTokenBucket verifies that a bucket holds transfers to its rate and
+// that a rate of 0 doesn't limit at all
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1 << 20)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := bucket.wait(context.Background(), 256<<10, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first write overdraws the empty bucket, the next four pay it back
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected 1MB at 1MB/s to take about 1s, took %s", elapsed)
+	}
+
+	bucket.setRate(0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		bucket.wait(context.Background(), 1<<20, false, false)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected unlimited bucket not to wait, took %s", elapsed)
+	}
+}
+
+// TestTokenBucketCancel verifies that a waiting transfer gives up when its
+// context ends
+func TestTokenBucketCancel(t *testing.T) {
+	bucket := newTokenBucket(1024)
+	bucket.wait(context.Background(), 1<<20, false, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := bucket.wait(ctx, 1024, false, false); err == nil {
+		t.Errorf("expected wait to fail once the context was cancelled")
+	}
+}
+
+func TestConfigureBandwidth(t *testing.T) {
+	configureBandwidth(BandwidthLimits{
+		Origin:      1000,
+		OriginHost:  500,
+		OriginHosts: map[string]int64{"dl.example.com": 2000},
+	})
+	defer configureBandwidth(BandwidthLimits{})
+
+	if rate := bandwidth.hostBucket("dl.example.com").getRate(); rate != 2000 {
+		t.Errorf("expected host override of 2000, got %d", rate)
+	}
+	if rate := bandwidth.hostBucket("other.example.com").getRate(); rate != 500 {
+		t.Errorf("expected default host rate of 500, got %d", rate)
+	}
+
+	// Existing buckets follow runtime changes
+	configureBandwidth(BandwidthLimits{OriginHost: 100})
+	if rate := bandwidth.hostBucket("dl.example.com").getRate(); rate != 100 {
+		t.Errorf("expected updated host rate of 100, got %d", rate)
+	}
+}
@@ -1,37 +1,80 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/segmentio/fasthash/fnv1a"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	url := generateURL(r)
-	h1 := generateCacheFilename(url, r)
+	_, keySpan := startSpan(r.Context(), "cache.key")
+	cacheKey := generateCacheKey(url, r)
+	h1 := hashCacheKey(cacheKey)
+	keySpan.SetAttributes(attribute.String("tenta.cache_key", h1))
+	keySpan.End()
 	filename := fmt.Sprintf("%s/%s", args.dataDir, h1)
-	incRequests()
+	ip := clientIP(r)
+	policy := hostPolicyFor(r.Host)
 
-	if args.debug {
-		log.Printf("Request for %s (%s)", filename, url)
+	// Siblings asking whether we have something aren't client requests, the
+	// GET that follows a yes is. Prefetches aren't either, nobody is waiting
+	// on them.
+	probe := onlyIfCached(r) && r.Method == http.MethodHead
+	client := !probe && r.RemoteAddr != prefetchClient
+	if client {
+		incRequests()
 	}
 
-	if r.Header.Get("tenta-proxy") == "true" {
+	if debugEnabled() {
+		log.Printf("Request from %s for %s (%s)", ip, filename, url)
+	}
+
+	if isProxyLoop(r) {
 		w.WriteHeader(http.StatusLoopDetected)
-		log.Printf("Sending Proxy loop detected, aborting")
+		log.Printf("Sending Proxy loop detected to %s, aborting", ip)
 		fmt.Fprintf(w, "Proxy loop detected, aborting")
 		incErrors()
 		return
 	}
 
-	_, err := os.Stat(filename)
+	_, lookupSpan := startSpan(r.Context(), "cache.lookup", attribute.String("tenta.cache_key", h1))
+	entry, err := indexGet(h1)
+	if policy.Bypass && err == nil {
+		// Entries cached before the host was bypassed are ignored
+		err = os.ErrNotExist
+	}
+	var file *os.File
+	if err == nil {
+		// Opened up front, files removed behind tenta's back are dropped
+		// from the index and fetched again
+		file, err = os.Open(filename)
+		if os.IsNotExist(err) {
+			log.Printf("Cache file %s is in the index but missing, removing it", filename)
+			subSize(entry.Size)
+			decFiles()
+			deleteMeta(h1)
+		} else if err == nil {
+			defer file.Close()
+		}
+	}
+	lookupSpan.SetAttributes(attribute.Bool("tenta.cached", err == nil), attribute.Bool("tenta.bypass", policy.Bypass))
+	if err != nil && !os.IsNotExist(err) {
+		endSpan(lookupSpan, err)
+	} else {
+		lookupSpan.End()
+	}
 	if err != nil {
 		if !os.IsNotExist(err) {
 			log.Printf("Error checking file: %s", err)
@@ -41,76 +84,57 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if args.debug {
+		if debugEnabled() {
 			log.Printf("Cache file %s not found", filename)
 		}
-		incMisses()
 
-		// Presumably, we're running custom DNS pointing to this
-		// We need to ignore that and use a custom DNS resolver
-		// Otherwise we will have a fun proxy loop situation
-		var (
-			dnsResolverIP        = "8.8.8.8:53" // Google DNS resolver.
-			dnsResolverProto     = "udp"        // Protocol to use for the DNS resolver
-			dnsResolverTimeoutMs = 5000         // Timeout (ms) for the DNS resolver (optional)
-		)
-
-		dialer := &net.Dialer{
-			Resolver: &net.Resolver{
-				PreferGo: true,
-				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-					d := net.Dialer{
-						Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-					}
-					return d.DialContext(ctx, dnsResolverProto, dnsResolverIP)
-				},
-			},
-		}
-
-		dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, addr)
-		}
-
-		http.DefaultTransport.(*http.Transport).DialContext = dialContext
-
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.Printf("Error creating request: %s", err)
-			incErrors()
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Error creating request")
+		// Peers asking whether we have something must not cause a fetch
+		setCacheStatus(r, h1, cacheStatusMiss)
+		if onlyIfCached(r) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintf(w, "Not cached")
 			return
 		}
+		if client {
+			incMisses()
+			recordClientRequest(ip, false)
+			publishEvent(Event{Type: eventMiss, Key: h1, URL: url, Client: ip})
+		}
+		w = limitClientWriter(w, r, false)
 
-		// Apply context with timeout from the incoming request
-		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(args.requestTimeout)*time.Second)
+		ctx, cancel := upstreamContext(r.Context())
 		defer cancel()
-		req = req.WithContext(ctx)
 
-		req.Header.Add("tenta-proxy", `true`)
-		req.Header.Add("request-timestamp", fmt.Sprintf("%d", time.Now().Unix()))
-
-		client := &http.Client{
-			Timeout: time.Duration(args.requestTimeout) * time.Second,
+		fetchStart := time.Now()
+		fetchCtx, fetchSpan := startSpan(ctx, "origin.fetch", attribute.String("http.url", url))
+		data, source, err := fetchWithRetry(fetchCtx, r, url)
+		addUpstreamTime(r, time.Since(fetchStart))
+		if err == nil {
+			fetchSpan.SetAttributes(attribute.String("tenta.source", source), attribute.Int("http.status_code", data.StatusCode))
 		}
-
-		data, err := client.Do(req)
+		endSpan(fetchSpan, err)
 		if err != nil {
 			log.Printf("Error fetching data: %s", err)
 			incErrors()
+			publishEvent(Event{Type: eventError, Key: h1, URL: url, Client: ip, Message: err.Error()})
 			w.WriteHeader(http.StatusBadGateway)
 			fmt.Fprintf(w, "Error fetching data from origin")
 			return
 		}
+		if debugEnabled() {
+			log.Printf("Fetched %s from %s", url, source)
+		}
 		defer data.Body.Close()
 
 		// Check cache control headers to see if we should cache this response
-		if !shouldCacheResponse(data) {
-			if args.debug {
+		if policy.Bypass || !shouldCacheResponse(data) {
+			setCacheStatus(r, h1, cacheStatusBypass)
+			if debugEnabled() {
 				log.Printf("Response should not be cached based on headers")
 			}
 			w.WriteHeader(data.StatusCode)
-			io.Copy(w, data.Body)
+			n, _ := io.Copy(w, data.Body)
+			addTraffic(r, upstreamTraffic(source, trafficPassthrough), n)
 			return
 		}
 
@@ -133,74 +157,164 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 				incServerErr()
 			}
 			w.WriteHeader(data.StatusCode)
-			io.Copy(w, data.Body)
+			n, _ := io.Copy(w, data.Body)
+			addTraffic(r, upstreamTraffic(source, trafficPassthrough), n)
 			return
 		}
 
-		file, err := os.Create(filename)
-		if err != nil {
-			// Still try to send the data to the client
-			sent, err := io.Copy(w, data.Body)
-			if err != nil {
-				log.Printf("Error creating local file, no data sent: %s", err)
+		// Too big to cache or no space left, just stream it through
+		if maxBodySize := maxBodySizeFor(policy); data.ContentLength > maxBodySize || isPassThroughMode() {
+			setCacheStatus(r, h1, cacheStatusBypass)
+			if debugEnabled() && data.ContentLength > maxBodySize {
+				log.Printf("Response %s exceeds max body size (%d > %d), not caching", url, data.ContentLength, maxBodySize)
+			} else if debugEnabled() {
+				log.Printf("Data dir is out of space, not caching %s", url)
 			}
-			log.Printf("Error creating local file, sent %d bytes: %s", sent, err)
-			incErrors()
+			setContentLength(w, data.ContentLength)
+			w.WriteHeader(http.StatusOK)
+			n, _ := io.Copy(w, data.Body)
+			addTraffic(r, upstreamTraffic(source, trafficPassthrough), n)
 			return
 		}
-		if args.debug {
-			log.Printf("Created cache file %s", filename)
-		}
-		defer file.Close()
 
-		// Limit the size of data we cache
-		limitedBody := io.LimitReader(data.Body, args.maxBodySize)
-		nRead, err := file.ReadFrom(limitedBody)
+		// Stream to the client while we fill the cache so large downloads
+		// don't sit silent until the whole file is on disk. The client
+		// follows the fill at its own pace and is waited for on the way out.
+		setContentLength(w, data.ContentLength)
+		w.WriteHeader(http.StatusOK)
+
+		download := startDownload(h1, url, ip, source, data.ContentLength)
+		defer download.finish()
+
+		fillStart := time.Now()
+		fillCtx, fillSpan := startSpan(ctx, "cache.write", attribute.String("tenta.cache_key", h1))
+		nRead, clientDone, err := fillCache(fillCtx, data, filename, maxBodySizeFor(policy), w, &download.written)
+		defer clientDone()
+		fillSpan.SetAttributes(attribute.Int64("tenta.bytes", nRead))
+		endSpan(fillSpan, err)
+		// Failed fills still used the bandwidth
+		addTraffic(r, upstreamTraffic(source, trafficOrigin), atomic.LoadInt64(&download.written))
+		if errors.Is(err, errBodyTooLarge) {
+			setCacheStatus(r, h1, cacheStatusBypass)
+			if debugEnabled() {
+				log.Printf("Response %s exceeds max body size (%d), not caching", url, maxBodySizeFor(policy))
+			}
+			return
+		}
 		if err != nil {
-			log.Printf("Error writing data: %s", err)
+			log.Printf("Error caching %s: %s", url, err)
 			incErrors()
+			if errors.Is(err, syscall.ENOSPC) {
+				requestDiskCheck()
+			}
+			publishEvent(Event{Type: eventError, Key: h1, URL: url, Client: ip, Message: err.Error()})
 			return
 		}
 
-		// Check if the response was larger than our limit
-		// If so, truncate the cache file
-		if nRead >= args.maxBodySize {
-			if args.debug {
-				log.Printf("Response %s exceeded max body size (%d >= %d), removing cache", filename, nRead, args.maxBodySize)
-			}
-			file.Close()
+		observeFillThroughput(nRead, time.Since(fillStart))
+		if err := writeMeta(newCacheMeta(h1, url, cacheKey, nRead, data.Header)); errors.Is(err, errIndexClosed) {
+			// Shutting down, the index would never learn about the file
+			log.Printf("Cache index closed while filling %s, not keeping it", filename)
 			os.Remove(filename)
-			incErrors()
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Response too large to cache")
 			return
+		} else if err != nil {
+			log.Printf("Error writing metadata for %s: %s", filename, err)
+			incErrors()
 		}
-
-		addSize(nRead)
-		incFiles()
-		if args.debug {
+		publishEvent(Event{Type: eventFillComplete, Key: h1, URL: url, Client: ip, Size: nRead, Source: source})
+		if debugEnabled() {
 			log.Printf("Cached %s as %s (%d bytes)", url, filename, nRead)
 		}
+		return
+	} else if probe {
+		setCacheStatus(r, h1, cacheStatusHit)
+		setContentLength(w, entry.Size)
+		w.WriteHeader(http.StatusOK)
+		return
 	} else {
-		incHits()
+		setCacheStatus(r, h1, cacheStatusHit)
+		if !entry.NoMeta && !entry.isFresh() {
+			setCacheStatus(r, h1, cacheStatusStale)
+		}
+		if client {
+			incHits()
+			recordClientRequest(ip, true)
+			recordMetaHit(h1)
+			publishEvent(Event{Type: eventHit, Key: h1, URL: url, Client: ip})
+		}
+		w = limitClientWriter(w, r, true)
 	}
 
-	fileBytes, err := os.ReadFile(filename)
-	if err != nil {
-		log.Printf("Error opening file: %s", err)
-		incErrors()
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error reading cached file")
+	if info, err := file.Stat(); err == nil {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	written, err := w.Write(fileBytes)
+	_, serveSpan := startSpan(r.Context(), "cache.serve", attribute.String("tenta.cache_key", h1))
+
+	written, err := io.Copy(w, diskReader{file})
+	addTraffic(r, trafficCache, written)
+	serveSpan.SetAttributes(attribute.Int64("tenta.bytes", written))
+	endSpan(serveSpan, err)
 	if err != nil {
 		log.Printf("Error serving %s: %s", filename, err)
 		incErrors()
 		return
 	}
-	log.Printf("Cached file found: %s (%d bytes)", filename, written)
+	log.Printf("Cached file found: %s (%d bytes to %s)", filename, written, ip)
+}
+
+// setContentLength passes on an upstream Content-Length. Responses of
+// unknown length (-1) are sent chunked instead.
+func setContentLength(w http.ResponseWriter, length int64) {
+	if length >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	}
+}
+
+// upstreamTraffic is how bytes fetched for a miss are accounted. Bytes from
+// a sibling stayed on the LAN, so they count like a cache hit.
+func upstreamTraffic(source string, traffic string) string {
+	if strings.HasPrefix(source, "sibling ") {
+		return trafficCache
+	}
+	return traffic
+}
+
+// newKeyRequest builds the request a client would have sent to tenta for
+// rawURL, so cache keys can be computed for URLs given to the API. The
+// user agent matters because of key rules like Steam's.
+func newKeyRequest(rawURL string, userAgent string) (*http.Request, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL, got %q", rawURL)
+	}
+
+	// Parse the path the way the server does for incoming requests
+	path, err := neturl.ParseRequestURI(u.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		Method: http.MethodGet,
+		URL:    path,
+		Host:   u.Host,
+		Header: http.Header{},
+	}
+	if u.Scheme != "http" {
+		r.Header.Set("Scheme", u.Scheme)
+	}
+	if userAgent != "" {
+		r.Header.Set("User-Agent", userAgent)
+	}
+	return r, nil
 }
 
 func generateURL(r *http.Request) string {
@@ -211,17 +325,27 @@ func generateURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL)
 }
 
-func generateCacheFilename(url string, r *http.Request) string {
+// generateCacheKey returns the string a request is cached under, before
+// hashing. Usually that's the URL, but key rules can map several URLs to
+// one entry.
+func generateCacheKey(url string, r *http.Request) string {
 	cacheKey := url
-	// Steam has too many CDN URLs, but they have a consistent URL
-	// We can assume that if the user agent is Steam, the cache key is the same
-	if r.UserAgent() == "Valve/Steam HTTP Client 1.0" {
-		cacheKey = fmt.Sprintf("%s%s", "steam", r.URL)
+	if rule, ok := matchKeyRule(r); ok {
+		cacheKey = expandKey(rule.Key, url, r)
 	}
 
-	if args.debug {
+	if debugEnabled() {
 		log.Printf("Generated cache key: %s", cacheKey)
 	}
 
+	return cacheKey
+}
+
+func generateCacheFilename(url string, r *http.Request) string {
+	return hashCacheKey(generateCacheKey(url, r))
+}
+
+// hashCacheKey turns a cache key into the filename it is stored under
+func hashCacheKey(cacheKey string) string {
 	return fmt.Sprintf("%d", fnv1a.HashString64(cacheKey))
 }
@@ -149,3 +149,41 @@ func TestSizeMetrics(t *testing.T) {
 		t.Errorf("decFiles() failed: expected %d, got %d", initialFiles, getFilesCount())
 	}
 }
+
+// TestNewKeyRequest verifies that URLs given to the API map to the same
+// cache files as the equivalent proxied requests
+func TestNewKeyRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "generic URL",
+			url:      "http://google.com/",
+			expected: "3495272084109939400",
+		},
+		{
+			name:      "steam client",
+			url:       "http://google.com/abc123",
+			userAgent: "Valve/Steam HTTP Client 1.0",
+			expected:  "13712127455315645540",
+		},
+	}
+
+	for _, test := range tests {
+		r, err := newKeyRequest(test.url, test.userAgent)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if filename := generateCacheFilename(generateURL(r), r); filename != test.expected {
+			t.Errorf("%s: expected filename `%s` doesn't match `%s`", test.name, test.expected, filename)
+		}
+	}
+
+	if _, err := newKeyRequest("/relative/path", ""); err == nil {
+		t.Errorf("expected relative URL to be rejected")
+	}
+}
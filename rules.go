@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// KeyRule maps requests to a shared cache key. A rule applies when its
+// host and user agent both match; empty fields match anything. The key
+// template may use {url}, {uri}, {host} and {path}.
+type KeyRule struct {
+	Name      string `yaml:"name" toml:"name" json:"name"`
+	Host      string `yaml:"host" toml:"host" json:"host,omitempty"`
+	UserAgent string `yaml:"user-agent" toml:"user-agent" json:"user_agent,omitempty"`
+	Key       string `yaml:"key" toml:"key" json:"key"`
+}
+
+// HostPolicy changes how responses from matching origin hosts are cached.
+// Bypassed hosts are always passed through; a max body size overrides
+// --max-body-size for the host.
+type HostPolicy struct {
+	Host        string `yaml:"host" toml:"host" json:"host"`
+	Bypass      bool   `yaml:"bypass" toml:"bypass" json:"bypass"`
+	MaxBodySize int64  `yaml:"max-body-size" toml:"max-body-size" json:"max_body_size,omitempty"`
+}
+
+// defaultKeyRules are used when the config file has no key-rules section
+var defaultKeyRules = []KeyRule{
+	// Steam has too many CDN URLs, but they have a consistent URL
+	// We can assume that if the user agent is Steam, the cache key is the same
+	{Name: "steam", UserAgent: "Valve/Steam HTTP Client 1.0", Key: "steam{uri}"},
+}
+
+var cacheRules = struct {
+	sync.RWMutex
+	keyRules     []KeyRule
+	hostPolicies []HostPolicy
+}{keyRules: defaultKeyRules}
+
+// setCacheRules replaces the key rules and host policies in effect
+func setCacheRules(keyRules []KeyRule, hostPolicies []HostPolicy) {
+	cacheRules.Lock()
+	defer cacheRules.Unlock()
+	cacheRules.keyRules = keyRules
+	cacheRules.hostPolicies = hostPolicies
+}
+
+// validateCacheRules checks key rules and host policies from a config file
+func validateCacheRules(keyRules []KeyRule, hostPolicies []HostPolicy) error {
+	for i, rule := range keyRules {
+		if rule.Key == "" {
+			return fmt.Errorf("key rule %d (%s) has no key", i+1, rule.Name)
+		}
+		if rule.Host == "" && rule.UserAgent == "" {
+			return fmt.Errorf("key rule %d (%s) needs a host or user-agent to match", i+1, rule.Name)
+		}
+	}
+	for i, policy := range hostPolicies {
+		if policy.Host == "" {
+			return fmt.Errorf("host policy %d has no host", i+1)
+		}
+		if policy.MaxBodySize < 0 {
+			return fmt.Errorf("host policy for %s: max-body-size must be >= 0", policy.Host)
+		}
+	}
+	return nil
+}
+
+// hostMatches compares a request host against "example.com" or
+// "*.example.com", ignoring case and any port
+func hostMatches(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// matchKeyRule returns the first key rule that applies to a request
+func matchKeyRule(r *http.Request) (KeyRule, bool) {
+	cacheRules.RLock()
+	defer cacheRules.RUnlock()
+	for _, rule := range cacheRules.keyRules {
+		if rule.Host != "" && !hostMatches(rule.Host, r.Host) {
+			continue
+		}
+		if rule.UserAgent != "" && rule.UserAgent != r.UserAgent() {
+			continue
+		}
+		return rule, true
+	}
+	return KeyRule{}, false
+}
+
+// expandKey fills in a key rule's template for a request
+func expandKey(template string, url string, r *http.Request) string {
+	return strings.NewReplacer(
+		"{url}", url,
+		"{uri}", r.URL.String(),
+		"{host}", strings.ToLower(r.Host),
+		"{path}", r.URL.Path,
+	).Replace(template)
+}
+
+// hostPolicyFor returns the first policy matching a request host, or the
+// zero policy
+func hostPolicyFor(host string) HostPolicy {
+	cacheRules.RLock()
+	defer cacheRules.RUnlock()
+	for _, policy := range cacheRules.hostPolicies {
+		if hostMatches(policy.Host, host) {
+			return policy
+		}
+	}
+	return HostPolicy{}
+}
+
+// maxBodySizeFor is the largest response cached for a host
+func maxBodySizeFor(policy HostPolicy) int64 {
+	if policy.MaxBodySize > 0 {
+		return policy.MaxBodySize
+	}
+	return args.maxBodySize
+}
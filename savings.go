@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kinds of traffic for bandwidth savings. Bytes from a sibling count as
+// cache traffic since they never crossed the WAN.
+const (
+	trafficCache       = "cache"
+	trafficOrigin      = "origin"
+	trafficPassthrough = "passthrough"
+)
+
+// savingsInterval is how often lifetime totals are written to disk
+const savingsInterval = time.Minute
+
+var (
+	tentaBandwidthBytes    *prometheus.CounterVec
+	tentaBytesSaved        prometheus.Counter
+	tentaBandwidthLifetime *prometheus.GaugeVec
+)
+
+func init() {
+	tentaBandwidthBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenta_bandwidth_bytes_total",
+		Help: "Bytes served from cache, fetched from origin to fill the cache, or passed through uncached, by origin host or key rule",
+	}, []string{"host", "type"})
+	tentaBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_bytes_saved_total",
+		Help: "Bytes served from cache that would otherwise have been fetched over the WAN",
+	})
+	tentaBandwidthLifetime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenta_bandwidth_lifetime_bytes",
+		Help: "Bandwidth totals kept across restarts, by type (cache, origin, passthrough and saved)",
+	}, []string{"type"})
+}
+
+// SavingsTotals counts bytes by where they came from
+type SavingsTotals struct {
+	FromCache   int64   `json:"bytes_from_cache"`
+	FromOrigin  int64   `json:"bytes_from_origin"`
+	Passthrough int64   `json:"bytes_passthrough"`
+	Saved       int64   `json:"bytes_saved"`
+	SavedRatio  float64 `json:"saved_ratio"`
+}
+
+func (s *SavingsTotals) add(traffic string, size int64) {
+	switch traffic {
+	case trafficCache:
+		s.FromCache += size
+	case trafficOrigin:
+		s.FromOrigin += size
+	case trafficPassthrough:
+		s.Passthrough += size
+	}
+}
+
+// derive fills in bytes saved: every byte served from cache is one that
+// didn't have to come over the WAN
+func (s SavingsTotals) derive() SavingsTotals {
+	s.Saved = s.FromCache
+	s.SavedRatio = 0
+	if total := s.FromCache + s.FromOrigin + s.Passthrough; total > 0 {
+		s.SavedRatio = float64(s.FromCache) / float64(total)
+	}
+	return s
+}
+
+// BandwidthSavings is the bandwidth section of /api/cache/stats. Hosts are
+// lifetime totals by the same labels as the per-host metrics.
+type BandwidthSavings struct {
+	TrackingSince time.Time                `json:"tracking_since"`
+	Lifetime      SavingsTotals            `json:"lifetime"`
+	SinceStart    SavingsTotals            `json:"since_start"`
+	Hosts         map[string]SavingsTotals `json:"hosts"`
+}
+
+// savingsState is what's kept in the savings file
+type savingsState struct {
+	TrackingSince time.Time                 `json:"tracking_since"`
+	Lifetime      SavingsTotals             `json:"lifetime"`
+	Hosts         map[string]*SavingsTotals `json:"hosts"`
+}
+
+var savings = struct {
+	sync.Mutex
+	state      savingsState
+	sinceStart SavingsTotals
+	dirty      bool
+}{state: savingsState{TrackingSince: time.Now().UTC(), Hosts: map[string]*SavingsTotals{}}}
+
+func savingsPath() string {
+	return filepath.Join(args.dataDir, internalDir, "savings.json")
+}
+
+// addTraffic accounts bytes sent for a request. Prefetches aren't sent to
+// anyone, so only what they fetch from the origin counts.
+func addTraffic(r *http.Request, traffic string, size int64) {
+	if size <= 0 || (traffic != trafficOrigin && r.RemoteAddr == prefetchClient) {
+		return
+	}
+
+	host := metricHost(r, false)
+	tentaBandwidthBytes.WithLabelValues(host, traffic).Add(float64(size))
+	if traffic == trafficCache {
+		tentaBytesSaved.Add(float64(size))
+	}
+
+	savings.Lock()
+	defer savings.Unlock()
+	savings.sinceStart.add(traffic, size)
+	savings.state.Lifetime.add(traffic, size)
+	hostTotals, ok := savings.state.Hosts[host]
+	if !ok {
+		hostTotals = &SavingsTotals{}
+		savings.state.Hosts[host] = hostTotals
+	}
+	hostTotals.add(traffic, size)
+	savings.dirty = true
+	setLifetimeMetrics(savings.state.Lifetime)
+}
+
+// setLifetimeMetrics exports the lifetime totals. Callers hold savings.
+func setLifetimeMetrics(totals SavingsTotals) {
+	tentaBandwidthLifetime.WithLabelValues(trafficCache).Set(float64(totals.FromCache))
+	tentaBandwidthLifetime.WithLabelValues(trafficOrigin).Set(float64(totals.FromOrigin))
+	tentaBandwidthLifetime.WithLabelValues(trafficPassthrough).Set(float64(totals.Passthrough))
+	tentaBandwidthLifetime.WithLabelValues("saved").Set(float64(totals.derive().Saved))
+}
+
+// getSavings returns the current totals for the stats API
+func getSavings() BandwidthSavings {
+	savings.Lock()
+	defer savings.Unlock()
+
+	result := BandwidthSavings{
+		TrackingSince: savings.state.TrackingSince,
+		Lifetime:      savings.state.Lifetime.derive(),
+		SinceStart:    savings.sinceStart.derive(),
+		Hosts:         map[string]SavingsTotals{},
+	}
+	for host, totals := range savings.state.Hosts {
+		result.Hosts[host] = totals.derive()
+	}
+	return result
+}
+
+// loadSavings restores lifetime totals saved by a previous run
+func loadSavings() error {
+	data, err := os.ReadFile(savingsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state := savingsState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Hosts == nil {
+		state.Hosts = map[string]*SavingsTotals{}
+	}
+
+	savings.Lock()
+	defer savings.Unlock()
+	savings.state = state
+	savings.sinceStart = SavingsTotals{}
+	setLifetimeMetrics(state.Lifetime)
+	return nil
+}
+
+// saveSavings writes the lifetime totals if anything changed
+func saveSavings() error {
+	savings.Lock()
+	if !savings.dirty {
+		savings.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(savings.state)
+	savings.dirty = false
+	savings.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeStateFile(savingsPath(), data); err != nil {
+		// Try again next time
+		savings.Lock()
+		savings.dirty = true
+		savings.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeStateFile replaces one of tenta's state files. It is written under a
+// temporary name and renamed so a crash never leaves half a file.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// StartSavings loads lifetime totals and saves them periodically
+func StartSavings() {
+	if err := loadSavings(); err != nil {
+		log.Printf("Error loading bandwidth savings from %s, starting over: %s", savingsPath(), err)
+	}
+	go func() {
+		for range time.Tick(savingsInterval) {
+			if err := saveSavings(); err != nil {
+				log.Printf("Error saving bandwidth savings: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestBandwidthSavings sends a miss, a hit and an uncacheable response
+// through handleRequest and checks they're accounted and survive a restart
+func TestBandwidthSavings(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("01234"))
+			return
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	freshStats(t)
+	openTestIndex(t)
+	setupUpstream(t)
+
+	for _, path := range []string{"/file.pkg", "/file.pkg", "/private"} {
+		r, err := newKeyRequest(origin.URL+path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.RequestURI = r.URL.RequestURI()
+		handleRequest(httptest.NewRecorder(), r)
+	}
+
+	expected := SavingsTotals{FromCache: 10, FromOrigin: 10, Passthrough: 5, Saved: 10, SavedRatio: 0.4}
+	current := getSavings()
+	if current.Lifetime != expected || current.SinceStart != expected {
+		t.Errorf("expected %+v, got lifetime %+v and since start %+v", expected, current.Lifetime, current.SinceStart)
+	}
+	if len(current.Hosts) != 1 || current.Hosts[otherHosts] != expected {
+		t.Errorf("expected all traffic under %q, got %+v", otherHosts, current.Hosts)
+	}
+
+	if err := saveSavings(); err != nil {
+		t.Fatal(err)
+	}
+	restartStats(t)
+	restored := getSavings()
+	if restored.Lifetime != expected || restored.SinceStart != (SavingsTotals{}) {
+		t.Errorf("expected lifetime %+v and nothing since start after a restart, got %+v and %+v",
+			expected, restored.Lifetime, restored.SinceStart)
+	}
+	if !restored.TrackingSince.Equal(current.TrackingSince) {
+		t.Errorf("expected tracking since %s, got %s", current.TrackingSince, restored.TrackingSince)
+	}
+}
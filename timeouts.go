@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errReadStall is returned when the origin stops sending data for longer
+// than --upstream-idle-timeout
+var errReadStall = errors.New("upstream read stalled")
+
+// detachedContext keeps the values of its parent but not its cancellation,
+// so a fill keeps going if the client that triggered it disconnects
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// upstreamContext returns the context for an upstream fetch. The overall
+// --request-timeout is only applied when set; the individual phases are
+// bounded by the transport and by stallReader.
+func upstreamContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := context.Context(detachedContext{parent})
+	if args.requestTimeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(args.requestTimeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// stallReader cancels an upstream request when no data has arrived for
+// --upstream-idle-timeout. Unlike a total timeout, a slow but steady
+// download of any size is allowed to finish. Closing it releases the
+// request's context.
+type stallReader struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	stalled int32
+}
+
+// throttler is implemented by bodies that can block on a bandwidth limit
+type throttler interface {
+	throttled() bool
+}
+
+func newStallReader(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	s := &stallReader{
+		body:    body,
+		cancel:  cancel,
+		timeout: time.Duration(args.upstreamIdleTimeout) * time.Second,
+	}
+	if s.timeout > 0 {
+		s.timer = time.AfterFunc(s.timeout, func() {
+			// Waiting on our own bandwidth limit isn't the origin stalling
+			if t, ok := body.(throttler); ok && t.throttled() {
+				s.timer.Reset(s.timeout)
+				return
+			}
+			atomic.StoreInt32(&s.stalled, 1)
+			cancel()
+		})
+	}
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 && s.timer != nil {
+		s.timer.Reset(s.timeout)
+	}
+	if err != nil && err != io.EOF && atomic.LoadInt32(&s.stalled) == 1 {
+		err = errReadStall
+	}
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	err := s.body.Close()
+	s.cancel()
+	return err
+}
+
+type connContextKey struct{}
+
+// saveConnInContext makes the client connection available to handlers so
+// that write deadlines can be managed per write
+func saveConnInContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// withWriteIdleTimeout replaces a fixed server WriteTimeout, which would cut
+// off any download that takes longer than it, with a deadline that is pushed
+// back on every write. Only clients that stop reading are disconnected.
+func withWriteIdleTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+		if !ok || args.serverWriteIdleTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := time.Duration(args.serverWriteIdleTimeout) * time.Second
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+
+		next.ServeHTTP(&idleDeadlineWriter{ResponseWriter: w, conn: conn, timeout: timeout}, r)
+	})
+}
+
+type idleDeadlineWriter struct {
+	http.ResponseWriter
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *idleDeadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *idleDeadlineWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		f.Flush()
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanBody is an upstream body fed one chunk at a time. Like a real
+// response body, reads fail once its request's context is cancelled.
+type chanBody struct {
+	ctx    context.Context
+	chunks chan []byte
+}
+
+func (b *chanBody) Read(p []byte) (int, error) {
+	select {
+	case chunk, ok := <-b.chunks:
+		if !ok {
+			return 0, io.EOF
+		}
+		return copy(p, chunk), nil
+	case <-b.ctx.Done():
+		return 0, b.ctx.Err()
+	}
+}
+
+func (b *chanBody) Close() error { return nil }
+
+// TestStallReader verifies that a slow but steady body is read to the end
+// and a body that stops sending is cancelled after the idle timeout
+func TestStallReader(t *testing.T) {
+	saveArgs(t)
+	args.upstreamIdleTimeout = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body := &chanBody{ctx: ctx, chunks: make(chan []byte)}
+	reader := newStallReader(body, cancel)
+	defer reader.Close()
+
+	// Four chunks spread over longer than the idle timeout
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(400 * time.Millisecond)
+			body.chunks <- []byte("data")
+		}
+	}()
+	buf := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		if _, err := reader.Read(buf); err != nil {
+			t.Fatalf("read %d: expected a steady body to be read, got %s", i, err)
+		}
+	}
+
+	// Then nothing at all
+	start := time.Now()
+	if _, err := reader.Read(buf); err != errReadStall {
+		t.Errorf("expected errReadStall, got %v", err)
+	}
+	if waited := time.Since(start); waited < 500*time.Millisecond || waited > 3*time.Second {
+		t.Errorf("expected the stall to be detected after about 1s, took %s", waited)
+	}
+	if ctx.Err() == nil {
+		t.Error("expected the request context to be cancelled")
+	}
+}
+
+func TestStallReaderClose(t *testing.T) {
+	saveArgs(t)
+	args.upstreamIdleTimeout = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks := make(chan []byte)
+	close(chunks)
+	reader := newStallReader(&chanBody{ctx: ctx, chunks: chunks}, cancel)
+
+	if _, err := reader.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	reader.Close()
+	if ctx.Err() == nil {
+		t.Error("expected Close to release the request context")
+	}
+}
+
+type contextKey string
+
+// TestUpstreamContext verifies that upstream fetches outlive the client
+// request but keep its values and honour --request-timeout
+func TestUpstreamContext(t *testing.T) {
+	saveArgs(t)
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), contextKey("k"), "v"))
+	cancelParent()
+
+	args.requestTimeout = 0
+	ctx, cancel := upstreamContext(parent)
+	if ctx.Err() != nil {
+		t.Errorf("expected a cancelled client not to cancel the fetch, got %s", ctx.Err())
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without --request-timeout")
+	}
+	if ctx.Value(contextKey("k")) != "v" {
+		t.Error("expected the client request's values to be kept")
+	}
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("expected the fetch to be cancelled by its own cancel, got %v", ctx.Err())
+	}
+
+	args.requestTimeout = 30
+	ctx, cancel = upstreamContext(parent)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 30*time.Second {
+		t.Errorf("expected a deadline within 30s, got %s (%t)", deadline, ok)
+	}
+}
+
+// idleTimeoutServer serves handler the way the proxy does, with the write
+// idle timeout applied per connection
+func idleTimeoutServer(handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewUnstartedServer(withWriteIdleTimeout(handler))
+	server.Config.ConnContext = saveConnInContext
+	server.Start()
+	return server
+}
+
+// TestWriteIdleTimeout verifies that a slow download isn't cut off by the
+// write timeout while a client that stops reading is
+func TestWriteIdleTimeout(t *testing.T) {
+	saveArgs(t)
+	args.serverWriteIdleTimeout = 1
+
+	slow := idleTimeoutServer(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(400 * time.Millisecond)
+		}
+	})
+	defer slow.Close()
+
+	resp, err := http.Get(slow.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || strings.Count(string(body), "chunk") != 4 {
+		t.Errorf("expected all 4 chunks of a slow response, got %q: %v", body, err)
+	}
+
+	writeErr := make(chan error, 1)
+	stalled := idleTimeoutServer(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 4096; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	})
+	defer stalled.Close()
+
+	// Send a request and never read the response
+	conn, err := net.Dial("tcp", stalled.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: tenta\r\n\r\n")
+	bufio.NewReader(conn).Peek(1)
+
+	select {
+	case err := <-writeErr:
+		if err == nil {
+			t.Error("expected writes to a client that stopped reading to fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("expected writes to a client that stopped reading to time out")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var otelProtocols = []string{"grpc", "http"}
+
+// tracer creates tenta's spans. Until StartTracing installs a provider it
+// is a no-op.
+var tracer = otel.Tracer("github.com/jeefy/tenta")
+
+// tracingEnabled is set once spans are being exported
+var tracingEnabled bool
+
+// validateTracing checks the OpenTelemetry flags
+func validateTracing() error {
+	known := false
+	for _, protocol := range otelProtocols {
+		known = known || protocol == args.otelProtocol
+	}
+	if !known {
+		return fmt.Errorf("otel-protocol must be one of %s, got %q", strings.Join(otelProtocols, ", "), args.otelProtocol)
+	}
+	if args.otelSampleRatio < 0 || args.otelSampleRatio > 1 {
+		return fmt.Errorf("otel-sample-ratio must be between 0 and 1, got %g", args.otelSampleRatio)
+	}
+	return nil
+}
+
+// newTraceExporter connects to the collector at --otel-endpoint
+func newTraceExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+	if args.otelProtocol == "http" {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(args.otelEndpoint)}
+		if args.otelInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(args.otelEndpoint)}
+	if args.otelInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// StartTracing exports spans to the configured OTLP collector and turns on
+// W3C trace context propagation. The returned function flushes and stops
+// the exporter.
+func StartTracing() (func(), error) {
+	if args.otelEndpoint == "" {
+		return func() {}, nil
+	}
+
+	exporter, err := newTraceExporter(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(args.otelServiceName),
+		semconv.ServiceInstanceIDKey.String(args.instanceID),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(args.otelSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+
+	log.Printf("Exporting traces over OTLP/%s to %s (sample ratio %g)", args.otelProtocol, args.otelEndpoint, args.otelSampleRatio)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Error flushing traces: %s", err)
+		}
+	}, nil
+}
+
+// withTracing starts a server span for every proxied request, continuing
+// any trace the client sent. API calls aren't traced.
+func withTracing(next http.Handler) http.Handler {
+	if !tracingEnabled {
+		return next
+	}
+	return otelhttp.NewHandler(next, "proxy",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !strings.HasPrefix(r.URL.Path, "/api/")
+		}),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return operation + " " + r.Method
+		}),
+	)
+}
+
+// traceTransport makes upstream requests child spans of the request that
+// caused them and sends the trace context to the origin
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	if !tracingEnabled {
+		return base
+	}
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return "upstream " + r.Method
+	}))
+}
+
+// startSpan starts a child span of the request's current span
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceCacheStatus adds the cache outcome to the request's span
+func traceCacheStatus(r *http.Request, key string, status string) {
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("tenta.cache_status", status),
+		attribute.String("tenta.cache_key", key),
+	)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestTracing checks the spans of a miss and a hit, and that the trace
+// context reaches the origin
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracingEnabled = true
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		tracingEnabled = false
+	}()
+
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	saveArgs(t)
+	args.dataDir = t.TempDir()
+	openTestIndex(t)
+	setupUpstream(t)
+	upstreamClient = &http.Client{Transport: traceTransport(http.DefaultTransport)}
+
+	handler := withTracing(http.HandlerFunc(handleRequest))
+	for i := 0; i < 2; i++ {
+		r, err := newKeyRequest(origin.URL+"/file.pkg", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	expected := map[string]int{
+		"proxy GET":    2,
+		"cache.key":    2,
+		"cache.lookup": 2,
+		"origin.fetch": 1,
+		"upstream GET": 1,
+		"cache.write":  1,
+		"cache.serve":  1,
+	}
+	for name, count := range expected {
+		if len(spans[name]) != count {
+			t.Errorf("expected %d %q spans, got %d", count, name, len(spans[name]))
+		}
+	}
+	if t.Failed() {
+		return
+	}
+
+	statuses := []string{}
+	for _, span := range spans["proxy GET"] {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "tenta.cache_status" {
+				statuses = append(statuses, attr.Value.AsString())
+			}
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != cacheStatusMiss || statuses[1] != cacheStatusHit {
+		t.Errorf("expected MISS then HIT on the request spans, got %v", statuses)
+	}
+
+	miss := spans["proxy GET"][0].SpanContext()
+	fetch := spans["origin.fetch"][0]
+	if fetch.Parent().SpanID() != miss.SpanID() {
+		t.Error("origin.fetch is not a child of the request span")
+	}
+	upstream := spans["upstream GET"][0]
+	if upstream.Parent().SpanID() != fetch.SpanContext().SpanID() {
+		t.Error("the upstream request is not a child of origin.fetch")
+	}
+	if want := "00-" + miss.TraceID().String() + "-" + upstream.SpanContext().SpanID().String() + "-01"; traceparent != want {
+		t.Errorf("expected traceparent %s at the origin, got %q", want, traceparent)
+	}
+}
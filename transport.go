@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamClient is shared by every origin, parent and sibling fetch so that
+// connections are pooled across requests. It is built once by StartUpstream.
+var upstreamClient *http.Client
+
+// newUpstreamDialer returns a dialer that resolves names through
+// --dns-resolver rather than the system resolver. With several resolvers
+// each lookup attempt uses the next one, so a dead resolver only costs a
+// retry.
+//
+// Presumably, we're running custom DNS pointing to this
+// We need to ignore that and use a custom DNS resolver
+// Otherwise we will have a fun proxy loop situation
+func newUpstreamDialer() *net.Dialer {
+	keepAlive := time.Duration(args.upstreamKeepAlive) * time.Second
+	if args.upstreamKeepAlive == 0 {
+		keepAlive = -1
+	}
+
+	resolvers := append([]string{}, args.dnsResolvers...)
+	var next uint32
+
+	return &net.Dialer{
+		Timeout:   time.Duration(args.upstreamDialTimeout) * time.Second,
+		KeepAlive: keepAlive,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{
+					Timeout: 5 * time.Second,
+				}
+				resolver := resolvers[int(atomic.AddUint32(&next, 1)-1)%len(resolvers)]
+				return d.DialContext(ctx, "udp", resolver)
+			},
+		},
+	}
+}
+
+// upstreamProxy returns the proxy selection function for --upstream-proxy
+func upstreamProxy() (func(*http.Request) (*url.URL, error), error) {
+	switch args.upstreamProxy {
+	case "":
+		return nil, nil
+	case "env":
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(args.upstreamProxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("upstream-proxy must be empty, \"env\" or a URL, got %q", args.upstreamProxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// newUpstreamTransport builds the transport used for all upstream requests
+func newUpstreamTransport() (*http.Transport, error) {
+	proxy, err := upstreamProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := newUpstreamDialer()
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				incUpstreamDialErrors()
+				return nil, err
+			}
+			incUpstreamDials()
+			return newCountedConn(conn), nil
+		},
+		ForceAttemptHTTP2:     args.upstreamHTTP2,
+		MaxIdleConns:          args.upstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   args.upstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       args.upstreamMaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(args.upstreamIdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(args.upstreamTLSHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(args.upstreamTTFBTimeout) * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     args.upstreamKeepAlive == 0,
+	}
+	if !args.upstreamHTTP2 {
+		// A non-nil empty map is the documented way to turn HTTP/2 off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
+
+// StartUpstream builds the shared upstream client from the configuration
+func StartUpstream() error {
+	transport, err := newUpstreamTransport()
+	if err != nil {
+		return err
+	}
+
+	// No client Timeout: it would cover reading the whole body and cut off
+	// large downloads. upstreamContext applies --request-timeout if set.
+	upstreamClient = &http.Client{
+		Transport: traceTransport(&instrumentedTransport{base: transport}),
+	}
+
+	log.Printf("Upstream transport: resolver=%s, maxIdle=%d, maxIdlePerHost=%d, http2=%t, proxy=%q",
+		strings.Join(args.dnsResolvers, ","), args.upstreamMaxIdleConns, args.upstreamMaxIdleConnsPerHost, args.upstreamHTTP2, args.upstreamProxy)
+	return nil
+}
+
+// instrumentedTransport records connection pool statistics and phase
+// timings for each request
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := newUpstreamTrace().clientTrace(func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			incUpstreamConnsReused()
+		}
+	})
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	incUpstreamInFlight()
+	defer decUpstreamInFlight()
+
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the pool
+func (t *instrumentedTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// countedConn keeps the open upstream connection gauge accurate
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func newCountedConn(conn net.Conn) *countedConn {
+	incUpstreamConnsOpen()
+	return &countedConn{Conn: conn}
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(decUpstreamConnsOpen)
+	return c.Conn.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestUpstreamDialerResolvers verifies that DNS lookups go to the configured
+// resolvers in turn, whatever address the resolver asks for
+func TestUpstreamDialerResolvers(t *testing.T) {
+	saveArgs(t)
+	args.dnsResolvers = []string{"127.0.0.1:5301", "127.0.0.1:5302"}
+	args.upstreamDialTimeout = 1
+	dialer := newUpstreamDialer()
+
+	expected := []string{"127.0.0.1:5301", "127.0.0.1:5302", "127.0.0.1:5301", "127.0.0.1:5302"}
+	for i, resolver := range expected {
+		conn, err := dialer.Resolver.Dial(context.Background(), "udp", "192.0.2.1:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != resolver {
+			t.Errorf("lookup %d: expected resolver %s, got %s", i, resolver, got)
+		}
+		conn.Close()
+	}
+}
+
+// TestUpstreamConnMetrics verifies that dials, reuse and open connections
+// are counted by the shared upstream transport
+func TestUpstreamConnMetrics(t *testing.T) {
+	saveArgs(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	args.dnsResolvers = []string{"127.0.0.1:53"}
+	args.upstreamProxy = ""
+	args.upstreamKeepAlive = 30
+	args.upstreamMaxIdleConns = 10
+	args.upstreamMaxIdleConnsPerHost = 10
+	args.upstreamMaxConnsPerHost = 0
+	args.upstreamIdleConnTimeout = 90
+	args.upstreamDialTimeout = 5
+	defer func(client *http.Client) { upstreamClient = client }(upstreamClient)
+	if err := StartUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	dials := testutil.ToFloat64(tentaUpstreamDials)
+	reused := testutil.ToFloat64(tentaUpstreamConnsReused)
+	open := testutil.ToFloat64(tentaUpstreamConnsOpen)
+
+	for i := 0; i < 2; i++ {
+		resp, err := upstreamClient.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(tentaUpstreamDials) - dials; got != 1 {
+		t.Errorf("expected 1 dial, got %v", got)
+	}
+	if got := testutil.ToFloat64(tentaUpstreamConnsReused) - reused; got != 1 {
+		t.Errorf("expected 1 reused connection, got %v", got)
+	}
+	if got := testutil.ToFloat64(tentaUpstreamConnsOpen) - open; got != 1 {
+		t.Errorf("expected 1 open connection, got %v", got)
+	}
+
+	upstreamClient.CloseIdleConnections()
+	if got := testutil.ToFloat64(tentaUpstreamConnsOpen) - open; got != 0 {
+		t.Errorf("expected no open connections after closing idle ones, got %v", got)
+	}
+}
+
+func TestCountedConnClose(t *testing.T) {
+	open := testutil.ToFloat64(tentaUpstreamConnsOpen)
+	client, server := net.Pipe()
+	defer server.Close()
+
+	conn := newCountedConn(client)
+	if got := testutil.ToFloat64(tentaUpstreamConnsOpen) - open; got != 1 {
+		t.Errorf("expected 1 open connection, got %v", got)
+	}
+
+	// Closing twice must only be counted once
+	conn.Close()
+	conn.Close()
+	if got := testutil.ToFloat64(tentaUpstreamConnsOpen) - open; got != 0 {
+		t.Errorf("expected no open connections, got %v", got)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// diskCheckInterval is how often free space in the data dir is measured
+const diskCheckInterval = 10 * time.Second
+
+// diskHighWatermark and diskLowWatermark are --disk-high-watermark and
+// --disk-low-watermark, parsed by validateWatermarks. Both are amounts of
+// free space: eviction starts when free space drops below the high
+// watermark and stops once the low watermark is free again.
+var diskHighWatermark, diskLowWatermark spaceThreshold
+
+// passThroughMode is set while eviction can't free enough space. New
+// misses are streamed to clients without being cached.
+var passThroughMode int32
+
+// diskCheckRequests wakes the disk monitor before its next tick
+var diskCheckRequests = make(chan struct{}, 1)
+
+var (
+	tentaDiskFree         prometheus.Gauge
+	tentaDiskSize         prometheus.Gauge
+	tentaPassThroughMode  prometheus.Gauge
+	tentaDiskEvictions    prometheus.Counter
+	tentaDiskEvictedBytes prometheus.Counter
+)
+
+func init() {
+	tentaDiskFree = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tenta_disk_free_bytes",
+		Help: "Free space available to tenta on the data dir filesystem",
+	})
+	tentaDiskSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tenta_disk_size_bytes",
+		Help: "Size of the data dir filesystem",
+	})
+	tentaPassThroughMode = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tenta_pass_through_mode",
+		Help: "1 while misses aren't cached because the data dir is out of space",
+	})
+	tentaDiskEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_disk_evictions_total",
+		Help: "The total number of cache entries evicted to free disk space",
+	})
+	tentaDiskEvictedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tenta_disk_evicted_bytes_total",
+		Help: "The total size of cache entries evicted to free disk space",
+	})
+}
+
+// validateWatermarks parses the free space watermarks
+func validateWatermarks() error {
+	var err error
+	if diskHighWatermark, err = parseSpaceThreshold(args.diskHighWatermark); err != nil {
+		return fmt.Errorf("disk-high-watermark: %w", err)
+	}
+	if diskLowWatermark, err = parseSpaceThreshold(args.diskLowWatermark); err != nil {
+		return fmt.Errorf("disk-low-watermark: %w", err)
+	}
+
+	// Mixed units can only be compared once the filesystem size is known
+	if (diskHighWatermark.percent > 0) == (diskLowWatermark.percent > 0) &&
+		diskLowWatermark.of(100) < diskHighWatermark.of(100) {
+		return fmt.Errorf("disk-low-watermark (%s) must leave at least as much free space as disk-high-watermark (%s)",
+			diskLowWatermark, diskHighWatermark)
+	}
+	return nil
+}
+
+// watermarksEnabled reports whether free space is managed at all
+func watermarksEnabled() bool {
+	return diskHighWatermark != (spaceThreshold{})
+}
+
+func isPassThroughMode() bool {
+	return atomic.LoadInt32(&passThroughMode) == 1
+}
+
+// setPassThroughMode switches caching of misses off or back on
+func setPassThroughMode(on bool, free uint64) {
+	value := int32(0)
+	if on {
+		value = 1
+	}
+	if atomic.SwapInt32(&passThroughMode, value) == value {
+		return
+	}
+
+	tentaPassThroughMode.Set(float64(value))
+	if on {
+		log.Printf("Only %d bytes free in %s after eviction, misses are passed through without caching", free, args.dataDir)
+	} else {
+		log.Printf("%d bytes free in %s, caching misses again", free, args.dataDir)
+	}
+}
+
+// requestDiskCheck asks the disk monitor to check free space now, e.g.
+// after a fill ran out of space
+func requestDiskCheck() {
+	select {
+	case diskCheckRequests <- struct{}{}:
+	default:
+	}
+}
+
+// evictLRU removes the least recently used cache entries until at least
+// target bytes are freed or the cache is empty
+func evictLRU(target uint64) (files int, freed uint64) {
+	flushMetaHits()
+	entries, err := indexLeastRecentlyUsed(target)
+	if err != nil {
+		log.Printf("Error listing cache entries to evict: %s", err)
+		incErrors()
+		return 0, 0
+	}
+
+	for _, entry := range entries {
+		if err := removeCacheEntry(entry.Key, entry.Size, "disk_space"); err != nil {
+			log.Printf("Error evicting %s: %s", entry.Key, err)
+			incErrors()
+			continue
+		}
+		tentaDiskEvictions.Inc()
+		tentaDiskEvictedBytes.Add(float64(entry.Size))
+		files++
+		freed += uint64(entry.Size)
+	}
+	return files, freed
+}
+
+// checkDiskSpace evicts toward the low watermark once free space is below
+// the high watermark, and turns on pass-through mode if that wasn't enough
+func checkDiskSpace() {
+	free, total, err := diskSpace(args.dataDir)
+	if err != nil {
+		if !errors.Is(err, errDiskSpaceUnsupported) {
+			log.Printf("Error checking free space in %s: %s", args.dataDir, err)
+			incErrors()
+		}
+		return
+	}
+	tentaDiskFree.Set(float64(free))
+	tentaDiskSize.Set(float64(total))
+
+	high := diskHighWatermark.of(total)
+	if free >= high {
+		setPassThroughMode(false, free)
+		return
+	}
+
+	low := diskLowWatermark.of(total)
+	if low < high {
+		low = high
+	}
+	files, freed := evictLRU(low - free)
+	if files > 0 {
+		log.Printf("%d bytes free in %s is below the high watermark, evicted %d files (%d bytes)", free, args.dataDir, files, freed)
+	}
+
+	if free, _, err = diskSpace(args.dataDir); err != nil {
+		log.Printf("Error checking free space in %s: %s", args.dataDir, err)
+		incErrors()
+		return
+	}
+	tentaDiskFree.Set(float64(free))
+	setPassThroughMode(free < high, free)
+}
+
+// StartDiskMonitor keeps free space in the data dir between the watermarks
+func StartDiskMonitor() {
+	if !watermarksEnabled() {
+		log.Println("Disk high watermark not set. Skipping free space monitor")
+		return
+	}
+	if _, _, err := diskSpace(args.dataDir); errors.Is(err, errDiskSpaceUnsupported) {
+		log.Printf("Free space watermarks are ignored: %s", err)
+		return
+	}
+
+	log.Printf("Keeping free space in %s above %s, evicting until %s is free", args.dataDir, diskHighWatermark, diskLowWatermark)
+	go func() {
+		ticker := time.NewTicker(diskCheckInterval)
+		defer ticker.Stop()
+		for {
+			checkDiskSpace()
+			select {
+			case <-ticker.C:
+			case <-diskCheckRequests:
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateWatermarks(t *testing.T) {
+	saveArgs(t)
+	defer func() {
+		diskHighWatermark, diskLowWatermark = spaceThreshold{}, spaceThreshold{}
+	}()
+
+	tests := []struct {
+		high  string
+		low   string
+		valid bool
+	}{
+		{"5%", "10%", true},
+		{"10G", "20G", true},
+		{"1G", "5%", true},
+		{"0", "0", true},
+		{"10%", "5%", false},
+		{"2G", "1G", false},
+		{"lots", "10%", false},
+	}
+	for _, test := range tests {
+		args.diskHighWatermark, args.diskLowWatermark = test.high, test.low
+		if err := validateWatermarks(); (err == nil) != test.valid {
+			t.Errorf("high=%s low=%s: expected valid=%t, got %v", test.high, test.low, test.valid, err)
+		}
+	}
+}
+
+// TestEvictLRU checks entries are evicted least recently used first
+func TestEvictLRU(t *testing.T) {
+	seedCache(t, "http://dl.example.com/a.pkg", "http://dl.example.com/b.pkg", "http://dl.example.com/c.pkg")
+	keys := map[string]string{}
+	ages := map[string]time.Duration{"a.pkg": time.Hour, "b.pkg": 3 * time.Hour, "c.pkg": 2 * time.Hour}
+	for name, age := range ages {
+		url := "http://dl.example.com/" + name
+		r, err := newKeyRequest(url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = generateCacheFilename(generateURL(r), r)
+		meta := newCacheMeta(keys[name], url, url, 10, http.Header{})
+		meta.LastAccess = time.Now().Add(-age).UTC()
+		if err := writeMeta(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, freed := evictLRU(15)
+	if files != 2 || freed != 20 {
+		t.Errorf("expected 2 files and 20 bytes evicted, got %d and %d", files, freed)
+	}
+	for name, kept := range map[string]bool{"a.pkg": true, "b.pkg": false, "c.pkg": false} {
+		if _, err := os.Stat(filepath.Join(args.dataDir, keys[name])); (err == nil) != kept {
+			t.Errorf("%s: expected kept=%t, got %v", name, kept, err)
+		}
+	}
+}
+
+// TestPassThroughMode fills the disk past a watermark nothing can satisfy
+// and checks misses are then served without being cached
+func TestPassThroughMode(t *testing.T) {
+	if _, _, err := diskSpace(os.TempDir()); errors.Is(err, errDiskSpaceUnsupported) {
+		t.Skip(err)
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	seedCache(t, "http://dl.example.com/a.pkg")
+	setupUpstream(t)
+	defer func() {
+		diskHighWatermark, diskLowWatermark = spaceThreshold{}, spaceThreshold{}
+		setPassThroughMode(false, 0)
+	}()
+
+	diskHighWatermark = spaceThreshold{bytes: 1 << 62}
+	diskLowWatermark = diskHighWatermark
+	checkDiskSpace()
+	if !isPassThroughMode() {
+		t.Fatal("expected pass-through mode when eviction can't free enough")
+	}
+	if files, _, _ := indexTotals(); files != 0 {
+		t.Errorf("expected every entry evicted, %d left", files)
+	}
+
+	r, err := newKeyRequest(origin.URL+"/file.pkg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	if w.Body.String() != "0123456789" {
+		t.Errorf("expected the origin's body, got %q", w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(args.dataDir, generateCacheFilename(generateURL(r), r))); err == nil {
+		t.Error("expected the response not to be cached in pass-through mode")
+	}
+
+	diskHighWatermark = spaceThreshold{bytes: 1}
+	checkDiskSpace()
+	if isPassThroughMode() {
+		t.Error("expected caching to resume once space is free")
+	}
+}